@@ -0,0 +1,263 @@
+package main
+
+// This file contains the amount normalizer stage. Amounts of the source file are free text like "$10",
+// "1.234,50 €" or "(12.00)". Each amount is parsed into integer minor units (cents) and an ISO 4217
+// currency code without any float conversion so that no rounding could happen. The original value is
+// kept along with the normalized one for audit purpose.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// map of currency symbols to their ISO 4217 code.
+var currencySymbols = map[string]string{
+	"US$": "USD",
+	"$":   "USD",
+	"€":   "EUR",
+	"£":   "GBP",
+	"¥":   "JPY",
+	"zł":  "PLN",
+	"₣":   "CHF",
+}
+
+// ISO 4217 codes of the active currencies. Three letters found beside an amount are only taken as its
+// currency when they are part of this list so that a value like "1abc" is not read as ABC.
+var currencyCodes = strings.Fields(`
+	AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL BSD BTN BWP BYN BZD
+	CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD
+	GNF GTQ GYD HKD HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT
+	LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR
+	NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP
+	STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD UYU UZS VES VND VUV WST XAF XCD XOF
+	XPF YER ZAR ZMW ZWL`)
+
+// number of decimals (minor units) of the currencies which do not use two of them.
+var currencyDecimals = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// decimalsOf is a function that returns the number of minor units of a currency - two by default.
+func decimalsOf(currency string) int {
+	if n, ok := currencyDecimals[currency]; ok {
+		return n
+	}
+	return 2
+}
+
+// characters used as thousands separators beside the dot and the comma.
+var groupSeparators = strings.NewReplacer(" ", "", " ", "", " ", "", "'", "", "’", "")
+
+// A Money is a decimal amount held into minor units (cents for most currencies) with its ISO 4217 currency code.
+type Money struct {
+	Cents    int64
+	Currency string
+}
+
+// String formats the amount with the decimals of its currency such as 1234.50, -10.00, 1500 (JPY)
+// or 1.250 (KWD).
+func (m Money) String() string {
+	sign := ""
+	cents := m.Cents
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	decimals := decimalsOf(m.Currency)
+	if decimals == 0 {
+		return fmt.Sprintf("%s%d", sign, cents)
+	}
+	scale := int64(math.Pow10(decimals))
+	return fmt.Sprintf("%s%d.%0*d", sign, cents/scale, decimals, cents%scale)
+}
+
+// A NormalizedRecord is the structure of a record once its amount has been normalized. The
+// amount is sent into minor units with its currency and the original value is kept for audit.
+type NormalizedRecord struct {
+	Record
+	Amount         int64  `json:"amount"`
+	Currency       string `json:"currency"`
+	AmountOriginal string `json:"amount_original"`
+}
+
+// A NormalizedPaymentRecord is a structure to be used to build normalized json string before posting to API.
+type NormalizedPaymentRecord struct {
+	PaymentRecord NormalizedRecord `json:"PaymentRecord"`
+}
+
+// ParseAmount is a function that parses an amount like "$90", "1,234.50 EUR", "1.234,50 €" or "($12)"
+// into a Money. The currency defaults to currency when the value does not contain any symbol or ISO code.
+// The amount is scaled by the minor units of its currency: "¥1,500" gives 1500 and "1.250 KWD" gives 1250.
+// Negative amounts could be written with a minus sign or in parentheses as in accounting notation.
+func ParseAmount(value, currency string) (Money, error) {
+	s := strings.TrimSpace(value)
+	negative := false
+
+	// accounting notation could wrap the symbol or be wrapped by it like ($10) or $(10).
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative, s = true, strings.TrimSpace(s[1:len(s)-1])
+	}
+	code, s := extractCurrency(s)
+	if !negative && strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative, s = true, strings.TrimSpace(s[1:len(s)-1])
+	}
+
+	// minus sign could be placed before or after the symbol like -$10 or $-10.
+	if strings.HasPrefix(s, "-") {
+		negative, s = !negative, strings.TrimSpace(s[1:])
+	}
+	if code == "" {
+		code, s = extractCurrency(s)
+	}
+	if code == "" {
+		code = currency
+	}
+
+	decimals := decimalsOf(code)
+	decimal, err := normalizeSeparators(s, decimals)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q - %v", value, err)
+	}
+	cents, err := parseCents(decimal, decimals)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q - %v", value, err)
+	}
+	if negative {
+		cents = -cents
+	}
+	return Money{Cents: cents, Currency: code}, nil
+}
+
+// extractCurrency is a function that looks for a known symbol or a known three letters ISO code at
+// the start or at the end of the value. It returns the ISO code found and the remaining value.
+func extractCurrency(s string) (string, string) {
+	// longest symbols first so that US$ is not taken as $.
+	for _, symbol := range []string{"US$", "$", "€", "£", "¥", "zł", "₣"} {
+		if strings.HasPrefix(s, symbol) {
+			return currencySymbols[symbol], strings.TrimSpace(strings.TrimPrefix(s, symbol))
+		}
+		if strings.HasSuffix(s, symbol) {
+			return currencySymbols[symbol], strings.TrimSpace(strings.TrimSuffix(s, symbol))
+		}
+	}
+	if len(s) > 3 {
+		if isCurrencyCode(s[:3]) {
+			return strings.ToUpper(s[:3]), strings.TrimSpace(s[3:])
+		}
+		if isCurrencyCode(s[len(s)-3:]) {
+			return strings.ToUpper(s[len(s)-3:]), strings.TrimSpace(s[:len(s)-3])
+		}
+	}
+	return "", s
+}
+
+// isCurrencyCode reports if s is a known ISO 4217 code whatever its case.
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	code := strings.ToUpper(s)
+	for _, c := range currencyCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeSeparators is a function that removes thousands separators and turns the decimal
+// separator into a dot. When both dot and comma are present, the last one is the decimal one.
+// A single separator followed by exactly three digits is considered as thousands separator unless the
+// currency has three decimals. Currencies without decimals only have thousands separators.
+func normalizeSeparators(s string, decimals int) (string, error) {
+	s = groupSeparators.Replace(s)
+	dot, comma := strings.LastIndex(s, "."), strings.LastIndex(s, ",")
+
+	decimalSep, groupSep := "", ""
+	switch {
+	case dot != -1 && comma != -1:
+		decimalSep, groupSep = ".", ","
+		if comma > dot {
+			decimalSep, groupSep = ",", "."
+		}
+		if strings.Count(s, decimalSep) > 1 {
+			return "", errors.New("multiple decimal separators")
+		}
+	case dot != -1 || comma != -1:
+		sep := "."
+		if comma != -1 {
+			sep = ","
+		}
+		parts := strings.Split(s, sep)
+		if decimals == 0 || len(parts) > 2 || (len(parts[1]) == 3 && decimals != 3) {
+			groupSep = sep
+		} else {
+			decimalSep = sep
+		}
+	}
+
+	units, fraction := s, ""
+	if decimalSep != "" {
+		i := strings.LastIndex(s, decimalSep)
+		units, fraction = s[:i], s[i+1:]
+	}
+	if groupSep != "" {
+		// each group after the first one must hold exactly three digits.
+		groups := strings.Split(units, groupSep)
+		for i, group := range groups {
+			if len(group) == 0 || len(group) > 3 || (i > 0 && len(group) != 3) {
+				return "", errors.New("misplaced thousands separator")
+			}
+		}
+		units = strings.Join(groups, "")
+	}
+	if fraction != "" {
+		return units + "." + fraction, nil
+	}
+	return units, nil
+}
+
+// parseCents converts a plain decimal string with at most the given number of fractional digits into
+// minor units. It avoids any float conversion so that no rounding could happen.
+func parseCents(s string, decimals int) (int64, error) {
+	units, fraction := s, ""
+	if i := strings.Index(s, "."); i != -1 {
+		units, fraction = s[:i], s[i+1:]
+	}
+	if len(units) == 0 || len(fraction) > decimals {
+		return 0, fmt.Errorf("not a decimal value with at most %d decimals", decimals)
+	}
+	for len(fraction) < decimals {
+		fraction += "0"
+	}
+	for _, c := range units + fraction {
+		if c < '0' || c > '9' {
+			return 0, errors.New("not a decimal value")
+		}
+	}
+	return strconv.ParseInt(units+fraction, 10, 64)
+}
+
+// NormalizeAmounts is a function that rewrites the Amount field of each record into its canonical
+// decimal value then appends the currency code and the original value as extra fields. Records with
+// an amount which could not be parsed are returned as rejected with the reason.
+func NormalizeAmounts(records [][]string, currency string) ([][]string, []rejectedRecord) {
+	var rejects []rejectedRecord
+	normalized := records[:0]
+	for _, record := range records {
+		m, err := ParseAmount(record[9], currency)
+		if err != nil {
+			rejects = append(rejects, rejectedRecord{record: record, reason: err.Error()})
+			continue
+		}
+		original := record[9]
+		record[9] = m.String()
+		normalized = append(normalized, append(record, m.Currency, original))
+	}
+	return normalized, rejects
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	casesTable := []struct {
+		value string
+		want  Money
+	}{
+		{"$90", Money{Cents: 9000, Currency: "USD"}},
+		{"$00", Money{Cents: 0, Currency: "USD"}},
+		{"15", Money{Cents: 1500, Currency: "USD"}},
+		{"12.5 EUR", Money{Cents: 1250, Currency: "EUR"}},
+		{"zł10.99", Money{Cents: 1099, Currency: "PLN"}},
+		{"$1,234.50", Money{Cents: 123450, Currency: "USD"}},
+		{"1.234,50 €", Money{Cents: 123450, Currency: "EUR"}},
+		{"1 234,5 PLN", Money{Cents: 123450, Currency: "PLN"}},
+		{"12,99", Money{Cents: 1299, Currency: "USD"}},
+		{"1,000,000", Money{Cents: 100000000, Currency: "USD"}},
+		{"($12.00)", Money{Cents: -1200, Currency: "USD"}},
+		{"$(7)", Money{Cents: -700, Currency: "USD"}},
+		{"-£3.10", Money{Cents: -310, Currency: "GBP"}},
+		{"¥1,500", Money{Cents: 1500, Currency: "JPY"}},
+		{"15000 KRW", Money{Cents: 15000, Currency: "KRW"}},
+		{"1.250 KWD", Money{Cents: 1250, Currency: "KWD"}},
+		{"BHD 12.5", Money{Cents: 12500, Currency: "BHD"}},
+	}
+
+	for _, c := range casesTable {
+		got, err := ParseAmount(c.value, "USD")
+		if err != nil || got != c.want {
+			t.Errorf("parsing of %q was incorrect, got: %v (err: %v), wanted %v", c.value, got, err, c.want)
+		}
+	}
+
+	for _, value := range []string{"abc", "$", "1.2.3,4,5", "12,34,567", "1.99.9", "missing", "1abc", "¥10.5", "1.2345 KWD"} {
+		if m, err := ParseAmount(value, "USD"); err == nil {
+			t.Errorf("parsing of %q should have failed, got %v", value, m)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	casesTable := []struct {
+		money Money
+		want  string
+	}{
+		{Money{Cents: 123450, Currency: "USD"}, "1234.50"},
+		{Money{Cents: -1000, Currency: "EUR"}, "-10.00"},
+		{Money{Cents: 1500, Currency: "JPY"}, "1500"},
+		{Money{Cents: 1250, Currency: "KWD"}, "1.250"},
+	}
+
+	for _, c := range casesTable {
+		if got := c.money.String(); got != c.want {
+			t.Errorf("formatting of %#v was incorrect, got: %s, wanted %s", c.money, got, c.want)
+		}
+	}
+}
+
+func TestNormalizeAmounts(t *testing.T) {
+	input := [][]string{
+		{"01/04/2016", "Jerome AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$1,090", "Stripe", "08/04/2021"},
+		{"01/04/2017", "Jerome AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "ten", "Stripe", "08/04/2021"},
+	}
+
+	expected := [][]string{
+		{"01/04/2016", "Jerome AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "1090.00", "Stripe", "08/04/2021", "USD", "$1,090"},
+	}
+
+	got, rejects := NormalizeAmounts(input, "USD")
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("after normalization. got %v, wanted %v", got, expected)
+	}
+	if len(rejects) != 1 || rejects[0].record[9] != "ten" {
+		t.Errorf("got %d rejected records, wanted the one with amount \"ten\"", len(rejects))
+	}
+
+	normalizeAmount, currencyCode = true, "USD"
+	defer func() { normalizeAmount = false }()
+	data, err := buildPayload(newRecord(got[0]))
+	want := `{"PaymentRecord":{"date":"01/04/2016","name":"Jerome AMON","address":"Poland Street","address2":"missing","city":"Warsaw","state":"PL","zipcode":"38002","telephone":"missing","mobile":"000-000-0000","processor":"Stripe","importdate":"08/04/2021","amount":109000,"currency":"USD","amount_original":"$1,090"}}`
+	if err != nil || string(data) != want {
+		t.Errorf("got payload %s (err: %v), wanted: %s", data, err, want)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+// This file contains the batch mode used under cron, systemd or CI. It is enabled with the -batch
+// option or automatically when the program does not run into a terminal. In this mode the console is
+// not cleared, the program never waits for the user and the progress is written as plain lines. The
+// process exit code tells the outcome of the run:
+//
+//	0  success - all records were sent (or there was nothing to send).
+//	1  error - the run was aborted (download failure, unreadable file ...).
+//	2  config error - invalid or missing options.
+//	3  partial failure - some records failed to be sent.
+//	4  total failure - all records failed to be sent.
+//	5  source unchanged - the source file is the same as the previous run (with -skip-unchanged).
+//	6  out of sync - the reconciliation found differences between the source file and the backend.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// exit codes of the program.
+const (
+	exitCodeSuccess   = 0
+	exitCodeError     = 1
+	exitCodeConfig    = 2
+	exitCodePartial   = 3
+	exitCodeFailure   = 4
+	exitCodeUnchanged = 5
+	exitCodeOutOfSync = 6
+)
+
+// if true then the program runs without clearing the console nor waiting for the user.
+var batchMode bool
+
+// if true then the run stops when the source file did not change since the previous run.
+var skipUnchanged bool
+
+// progress step in percent between two plain progress lines of the batch mode.
+const batchProgressStep = 10
+
+// isTerminal reports if the standard input and output are both attached to a terminal.
+func isTerminal() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		info, err := f.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// exitCodeOf is a function that returns the exit code of a summary exit status.
+func exitCodeOf(status string) int {
+	switch status {
+	case exitSuccess:
+		return exitCodeSuccess
+	case exitPartial:
+		return exitCodePartial
+	case exitFailure:
+		return exitCodeFailure
+	case exitUnchanged:
+		return exitCodeUnchanged
+	case exitOutOfSync:
+		return exitCodeOutOfSync
+	}
+	return exitCodeError
+}
+
+// previousChecksum is a function that returns the source checksum of the latest successful run found
+// into the work folders of the pattern, other than the current one, which fetched the same source url.
+// Runs which failed for some records must process the file again so their checksum is never used, as
+// well as dry-runs and reconcile or diff runs which did not submit the file itself.
+func previousChecksum(pattern, current, source string) string {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return ""
+	}
+	// work folders names hold their creation time so the latest come last.
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	for _, file := range files {
+		if filepath.Dir(file) == filepath.Clean(current) {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var s RunSummary
+		if json.Unmarshal(data, &s) != nil || s.SourceURL != source || s.ExitStatus != exitSuccess {
+			continue
+		}
+		if s.DryRun || s.Reconcile != nil || s.Diff != nil {
+			continue
+		}
+		return s.SourceChecksum
+	}
+	return ""
+}
+
+// progressStepReached reports if the submission of total records went over a new progress step.
+// The last record always reaches a step.
+func progressStepReached(total, numOfRecords int) bool {
+	if numOfRecords == 0 {
+		return false
+	}
+	previous := (total - 1) * 100 / numOfRecords / batchProgressStep
+	current := total * 100 / numOfRecords / batchProgressStep
+	return current != previous || total == numOfRecords
+}
+
+// printBatchProgress prints a plain progress line each time the submission goes over a new step.
+func printBatchProgress(total, numOfRecords int) {
+	if progressStepReached(total, numOfRecords) {
+		fmt.Printf("\t[+] submission progression : %2.2f%% [%d/%d]%s\n", float64(total)/float64(numOfRecords)*100, total, numOfRecords, workersInfo())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExitCodeOf(t *testing.T) {
+	for status, want := range map[string]int{exitSuccess: 0, exitError: 1, exitPartial: 3, exitFailure: 4, exitUnchanged: 5, exitOutOfSync: 6, "": 1} {
+		if got := exitCodeOf(status); got != want {
+			t.Errorf("exitCodeOf(%q) got %d, wanted %d", status, got, want)
+		}
+	}
+}
+
+func TestPreviousChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	summaries := map[string]string{
+		"log@20211001.080000": `{"source_url":"http://host/data.csv","source_sha256":"aaaa","exit_status":"success"}`,
+		"log@20211002.080000": `{"source_url":"http://host/data.csv","source_sha256":"bbbb","exit_status":"partial_failure"}`,
+		"log@20211003.080000": `{"source_url":"http://host/data.csv","source_sha256":"cccc","exit_status":"error"}`,
+		"log@20211004.080000": `{"source_url":"http://host/other.csv","source_sha256":"dddd","exit_status":"success"}`,
+		"log@20211005.080000": `{"source_url":"http://host/data.csv","exit_status":"source_unchanged"}`,
+		"log@20211006.080000": `{"source_url":"http://host/data.csv","source_sha256":"ffff","exit_status":"success"}`,
+		"log@20211007.080000": `{"source_url":"http://host/data.csv","source_sha256":"gggg","dry_run":true,"exit_status":"success"}`,
+		"log@20211008.080000": `{"source_url":"http://host/data.csv","source_sha256":"hhhh","reconcile":{},"exit_status":"success"}`,
+		"log@20211009.080000": `{"source_url":"http://host/data.csv","source_sha256":"iiii","diff":{},"exit_status":"success"}`,
+	}
+	for folder, content := range summaries {
+		os.Mkdir(filepath.Join(dir, folder), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, folder, "summary.json"), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the current run folder, skipped runs, runs which did not succeed, dry-runs and reconcile or diff runs are ignored.
+	pattern := filepath.Join(dir, "log@*", "summary.json")
+	if got := previousChecksum(pattern, filepath.Join(dir, "log@20211006.080000"), "http://host/data.csv"); got != "aaaa" {
+		t.Errorf("got checksum %q, wanted aaaa", got)
+	}
+	if got := previousChecksum(pattern, "", "http://host/data.csv"); got != "ffff" {
+		t.Errorf("got checksum %q, wanted ffff", got)
+	}
+	if got := previousChecksum(pattern, "", "http://host/new.csv"); got != "" {
+		t.Errorf("got checksum %q for a new source", got)
+	}
+}
+
+func TestProgressStepReached(t *testing.T) {
+	var steps []int
+	for total := 1; total <= 25; total++ {
+		if progressStepReached(total, 25) {
+			steps = append(steps, total)
+		}
+	}
+	if want := []int{3, 5, 8, 10, 13, 15, 18, 20, 23, 25}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("got progress lines at %v, wanted %v", steps, want)
+	}
+	if progressStepReached(0, 0) {
+		t.Errorf("no progress expected without records")
+	}
+}
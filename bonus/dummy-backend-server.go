@@ -5,6 +5,7 @@
  Regarding the API, it expects to receive json data which matches PaymentRecord structure and will 200 or 202 status code.
  In case it failed to receive proper json data or failed to process the payload, it will reply to client with a json message
  which follows ApiResponse structure while setting appropriate http status error code.
+ Received records are kept into memory and listed page by page with GET /records?page=1&limit=100 requests.
 */
 
 package main
@@ -17,6 +18,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 )
 
 //== Pour envoyer la liste des questions en Json
@@ -49,21 +51,57 @@ type PaymentRecord struct {
 // sample key for verification
 const API_KEY = "my-key"
 
+// records received so far - listed by GET requests.
+var store struct {
+	sync.Mutex
+	records []PaymentRecord
+}
+
+// listPaymentRecords is a function that handles /records GET requests and sends back a page of the received records.
+func listPaymentRecords(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 100
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	records := []PaymentRecord{}
+	if start := (page - 1) * limit; start < len(store.records) {
+		end := start + limit
+		if end > len(store.records) {
+			end = len(store.records)
+		}
+		records = store.records[start:end]
+	}
+	json.NewEncoder(w).Encode(records)
+}
+
 // createPaymentRecord is a function that handles /records POST requests and emulate the record creation by printing on console.
 func createPaymentRecord(w http.ResponseWriter, r *http.Request) {
 
 	// by default return only json data
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
+	if (r.Method == "POST" || r.Method == "GET") && r.Header.Get("X-API-KEY") != API_KEY {
+		w.WriteHeader(401)
+		json.NewEncoder(w).Encode(ApiResponse{Status: 401, Error: "unauthorized access. bad key provided."})
+		return
+	}
+
+	// list the received records
+	if r.Method == "GET" {
+		listPaymentRecords(w, r)
+		return
+	}
+
 	// handle only http post method
 	if r.Method == "POST" {
 
-		if key := r.Header.Get("X-API-KEY"); key != API_KEY {
-			w.WriteHeader(401)
-			json.NewEncoder(w).Encode(ApiResponse{Status: 401, Error: "unauthorized access. bad key provided."})
-			return
-		}
-
 		// read the payload with into a safety manner by limiting
 		reqBody, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
 		if err != nil {
@@ -81,6 +119,9 @@ func createPaymentRecord(w http.ResponseWriter, r *http.Request) {
 
 		// mimic creation of the payment record by displaying on screen
 		log.Printf("successfully received new record - %v\n", paymentRecord)
+		store.Lock()
+		store.records = append(store.records, paymentRecord)
+		store.Unlock()
 
 		// could also use w.WriteHeader(http.StatusOK)
 		w.WriteHeader(http.StatusCreated)
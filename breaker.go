@@ -0,0 +1,270 @@
+package main
+
+// This file contains the circuit breaker of the API submissions. When the backend goes down during a run
+// the workers would keep calling it and every remaining record would end as a failure. Once the number of
+// consecutive outages (unreachable api, timeout or 5xx status) or their rate over the last calls reaches
+// the configured limit, the breaker opens: workers are paused and every probe interval a single held
+// record is sent as a trial (half-open state). A successful trial closes the breaker and all workers
+// resume while a failed one keeps it open. Records held during the outage are retried instead of failed
+// and only the attempts which are not held are written as failures into the statistics file. Once the
+// give up time is over, records fail right away but the trials go on until the API is back.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// possible states of the circuit breaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// errCircuitOpen is returned for the records still held when the breaker gives up.
+var errCircuitOpen = errors.New("circuit open")
+
+// A pendingFailure is an outage whose line into the statistics file is only written once the breaker
+// knows that the record is not held to be sent again.
+type pendingFailure struct {
+	err   error
+	write func()
+}
+
+// Error returns the reason of the outage.
+func (p *pendingFailure) Error() string { return p.err.Error() }
+
+// reportFailure is a function that writes the failure line of a call with write. With the breaker
+// enabled, an outage is returned with its line pending until the breaker decides about the record.
+func reportFailure(err error, write func()) error {
+	if breaker == nil || !isOutage(err) {
+		write()
+		return err
+	}
+	return &pendingFailure{err: err, write: write}
+}
+
+// BreakerOptions holds the settings of the circuit breaker.
+type BreakerOptions struct {
+	// number of consecutive outages opening the breaker - disabled when 0.
+	MaxFailures int
+	// rate of outages over the window of last calls opening the breaker - disabled when 0.
+	ErrorRate float64
+	// number of last calls used to compute the error rate.
+	Window int
+	// time between two trials while the breaker is open.
+	Probe time.Duration
+	// time after which the held records are failed if the breaker stays open - waits forever when 0.
+	GiveUp time.Duration
+}
+
+// settings of the circuit breaker of the current run.
+var breakerOptions = BreakerOptions{Window: 20, Probe: 5 * time.Second, GiveUp: 10 * time.Minute}
+
+// circuit breaker of the API submissions - nil when disabled.
+var breaker *Breaker
+
+// A Breaker pauses the submissions while the API is down. It is safe for concurrent use by workers.
+type Breaker struct {
+	opts BreakerOptions
+
+	mu          sync.Mutex
+	state       string
+	consecutive int
+	// outcomes of the last calls - true for an outage.
+	outcomes []bool
+	next     int
+	openedAt time.Time
+	probeAt  time.Time
+	// closed and replaced at each state change to wake up the paused workers.
+	changed chan struct{}
+	// number of times the breaker opened.
+	opened int
+}
+
+// newBreaker is a function that creates a closed circuit breaker.
+func newBreaker(opts BreakerOptions) *Breaker {
+	return &Breaker{opts: opts, state: breakerClosed, changed: make(chan struct{})}
+}
+
+// isOutage is a function that tells if the failure of a call means that the API is unavailable
+// rather than refusing the record itself.
+func isOutage(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return msg == "api unreachable" || msg == "api timeout" || strings.HasPrefix(msg, "api status 5")
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Opened returns the number of times the breaker opened.
+func (b *Breaker) Opened() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.opened
+}
+
+// Do calls send once the breaker lets it through. Outages while the breaker is open hold the record
+// which is sent again after a successful trial. It returns the error of the last call or errCircuitOpen
+// when the breaker gave up. The pending failure line of the last call is written unless the record is
+// held, and once the breaker gave up on the held record.
+func (b *Breaker) Do(send func() error) error {
+	var last *pendingFailure
+	for {
+		trial, err := b.acquire()
+		if err != nil {
+			if last != nil {
+				last.write()
+			}
+			return err
+		}
+		err = send()
+		held := b.done(err, trial)
+		if p, ok := err.(*pendingFailure); ok {
+			if !held {
+				p.write()
+			}
+			last, err = p, p.err
+		}
+		if !held {
+			return err
+		}
+		atomic.AddInt64(&metrics.retried, 1)
+	}
+}
+
+// setState changes the state and wakes up the paused workers. The caller holds the lock.
+func (b *Breaker) setState(state string) {
+	b.state = state
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// acquire blocks while the breaker is open. It returns true when the call is the trial of the
+// half-open state or errCircuitOpen when the breaker stayed open longer than the give up time and
+// no trial is due.
+func (b *Breaker) acquire() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		now := time.Now()
+		switch {
+		case b.state == breakerClosed:
+			return false, nil
+		case b.state == breakerOpen && !now.Before(b.probeAt):
+			b.setState(breakerHalfOpen)
+			logInfos.Printf("circuit breaker half-open - sending a trial record.\n")
+			return true, nil
+		case b.opts.GiveUp > 0 && now.Sub(b.openedAt) >= b.opts.GiveUp:
+			return false, errCircuitOpen
+		}
+
+		// wait for a state change, the next trial or the give up time.
+		wait := b.probeAt.Sub(now)
+		if b.state == breakerHalfOpen {
+			wait = b.opts.Probe
+		}
+		if b.opts.GiveUp > 0 {
+			if left := b.openedAt.Add(b.opts.GiveUp).Sub(now); left < wait {
+				wait = left
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+		b.mu.Lock()
+	}
+}
+
+// done records the outcome of a call and returns true when the record is held to be sent again. The
+// record of a failed trial is not held anymore once the give up time is over.
+func (b *Breaker) done(err error, trial bool) bool {
+	outage := isOutage(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if trial {
+		if outage {
+			now := time.Now()
+			b.probeAt = now.Add(b.opts.Probe)
+			b.setState(breakerOpen)
+			logInfos.Printf("circuit breaker trial failed - Errmsg: %v", err)
+			return b.opts.GiveUp == 0 || now.Sub(b.openedAt) < b.opts.GiveUp
+		}
+		b.consecutive, b.outcomes, b.next = 0, nil, 0
+		b.setState(breakerClosed)
+		logInfos.Printf("circuit breaker closed after %s - submission resumed.\n", time.Since(b.openedAt).Round(time.Second))
+		fmt.Print("\n\t[+] api available again - circuit breaker closed ... [ RESUMED ]\n")
+		return false
+	}
+
+	// calls started before the breaker opened.
+	if b.state != breakerClosed {
+		return outage
+	}
+
+	if outage {
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+	if b.opts.Window > 0 {
+		if len(b.outcomes) < b.opts.Window {
+			b.outcomes = append(b.outcomes, outage)
+		} else {
+			b.outcomes[b.next] = outage
+			b.next = (b.next + 1) % b.opts.Window
+		}
+	}
+	if !outage {
+		return false
+	}
+	reason := b.tripped()
+	if reason == "" {
+		return false
+	}
+
+	b.opened++
+	b.openedAt = time.Now()
+	b.probeAt = b.openedAt.Add(b.opts.Probe)
+	b.setState(breakerOpen)
+	logError.Printf("circuit breaker opened after %s - submission paused - Errmsg: %v", reason, err)
+	fmt.Printf("\n\t[+] api unavailable (%v) - circuit breaker open ... [ PAUSED ]\n", err)
+	return true
+}
+
+// tripped tells which limit the failures reached - empty when none. The caller holds the lock.
+func (b *Breaker) tripped() string {
+	if b.opts.MaxFailures > 0 && b.consecutive >= b.opts.MaxFailures {
+		return fmt.Sprintf("%d consecutive failures", b.consecutive)
+	}
+	if b.opts.ErrorRate <= 0 || len(b.outcomes) < b.opts.Window {
+		return ""
+	}
+	outages := 0
+	for _, o := range b.outcomes {
+		if o {
+			outages++
+		}
+	}
+	if float64(outages)/float64(len(b.outcomes)) >= b.opts.ErrorRate {
+		return fmt.Sprintf("%d failures over the last %d calls", outages, len(b.outcomes))
+	}
+	return ""
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerHoldsRecordsDuringOutage(t *testing.T) {
+	_, _, restore := captureLoggers()
+	defer restore()
+	defer func(m *Metrics) { metrics = m }(metrics)
+	metrics = newMetrics()
+
+	b := newBreaker(BreakerOptions{MaxFailures: 3, Window: 10, Probe: 20 * time.Millisecond, GiveUp: time.Second})
+	var down int32 = 1
+	var calls int32
+	send := func() error {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			return errors.New("api unreachable")
+		}
+		return nil
+	}
+
+	// the first failures are reported until the breaker opens.
+	for i := 0; i < 2; i++ {
+		if err := b.Do(send); err == nil {
+			t.Fatal("failure before the breaker opened was not reported")
+		}
+	}
+
+	// the record opening the breaker and the next ones are held until the api is back.
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- b.Do(send)
+		}()
+	}
+	time.Sleep(70 * time.Millisecond)
+	if b.State() == breakerClosed {
+		t.Fatal("breaker still closed after 3 consecutive outages")
+	}
+	held := atomic.LoadInt32(&calls)
+	atomic.StoreInt32(&down, 0)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("held record failed: %v", err)
+		}
+	}
+	if b.State() != breakerClosed || b.Opened() != 1 {
+		t.Errorf("got state %s opened %d times, wanted closed after opening once", b.State(), b.Opened())
+	}
+	// workers are paused: only trials reach the api while the breaker is open.
+	if held > 6 {
+		t.Errorf("got %d api calls during the outage, wanted at most 6", held)
+	}
+	if atomic.LoadInt64(&metrics.retried) == 0 {
+		t.Error("held records were not counted as retried")
+	}
+}
+
+func TestBreakerFailureLines(t *testing.T) {
+	_, stats, restore := captureLoggers()
+	defer restore()
+	defer func(m *Metrics, b *Breaker) { metrics, breaker = m, b }(metrics, breaker)
+	metrics = newMetrics()
+
+	breaker = newBreaker(BreakerOptions{MaxFailures: 2, Window: 10, Probe: 10 * time.Millisecond})
+	var calls int32
+	send := func() error {
+		// the api is back after the first trial.
+		if atomic.AddInt32(&calls, 1) > 3 {
+			return nil
+		}
+		return reportFailure(errors.New("api unreachable"), func() { logFailureRecords.Printf("record") })
+	}
+
+	if err := breaker.Do(send); err == nil || err.Error() != "api unreachable" {
+		t.Fatalf("got %v, wanted api unreachable", err)
+	}
+	if err := breaker.Do(send); err != nil {
+		t.Fatalf("got %v for the held record, wanted nil", err)
+	}
+	// only the failure before the breaker opened is a failure - the held attempts are not.
+	if got := strings.Count(stats.String(), "[ FAILURE ]"); got != 1 {
+		t.Errorf("got %d failure lines, wanted 1:\n%s", got, stats.String())
+	}
+
+	// refused records are written right away.
+	if err := reportFailure(errors.New("api status 400"), func() { logFailureRecords.Printf("record") }); err.Error() != "api status 400" {
+		t.Errorf("got %v, wanted api status 400", err)
+	}
+	if got := strings.Count(stats.String(), "[ FAILURE ]"); got != 2 {
+		t.Errorf("got %d failure lines, wanted 2", got)
+	}
+}
+
+func TestBreakerErrorRateAndGiveUp(t *testing.T) {
+	details, _, restore := captureLoggers()
+	defer restore()
+	defer func(m *Metrics) { metrics = m }(metrics)
+	metrics = newMetrics()
+
+	b := newBreaker(BreakerOptions{ErrorRate: 0.5, Window: 4, Probe: 10 * time.Millisecond, GiveUp: 50 * time.Millisecond})
+	outcomes := []error{nil, errors.New("api status 503"), errors.New("api status 400"), nil}
+	for _, err := range outcomes {
+		b.done(err, false)
+	}
+	// refused records are not outages so the rate is only 1/4.
+	if b.State() != breakerClosed {
+		t.Fatal("breaker opened below the error rate")
+	}
+	if !b.done(errors.New("api timeout"), false) || b.State() != breakerOpen {
+		t.Fatal("breaker did not open at the error rate")
+	}
+	if !strings.Contains(details.String(), "opened after 2 failures over the last 4 calls") {
+		t.Errorf("got %q, wanted the error rate as reason of the opening", details.String())
+	}
+
+	// the record fails as circuit open or with the failure of a trial after the give up time.
+	start := time.Now()
+	err := b.Do(func() error { return errors.New("api unreachable") })
+	if (err != errCircuitOpen && !isOutage(err)) || time.Since(start) < 40*time.Millisecond {
+		t.Errorf("got %v after %s, wanted a failure after the give up time", err, time.Since(start))
+	}
+
+	// trials go on after the give up time and close the breaker once the api is back.
+	deadline := time.Now().Add(time.Second)
+	for err != nil && time.Now().Before(deadline) {
+		err = b.Do(func() error { return nil })
+		if err != nil && err != errCircuitOpen {
+			t.Fatalf("got %v, wanted circuit open or nil", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil || b.State() != breakerClosed {
+		t.Errorf("got %v with state %s, wanted the breaker closed by a trial", err, b.State())
+	}
+}
+
+func TestBreakerGiveUpWhileDown(t *testing.T) {
+	_, stats, restore := captureLoggers()
+	defer restore()
+	defer func(m *Metrics, b *Breaker) { metrics, breaker = m, b }(metrics, breaker)
+	metrics = newMetrics()
+
+	// the api never comes back: every record must fail once the give up time is over.
+	breaker = newBreaker(BreakerOptions{MaxFailures: 1, Window: 10, Probe: 5 * time.Millisecond, GiveUp: 30 * time.Millisecond})
+	var attempted int32
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var once sync.Once
+			errs <- breaker.Do(func() error {
+				once.Do(func() { atomic.AddInt32(&attempted, 1) })
+				return reportFailure(errors.New("api unreachable"), func() { logFailureRecords.Printf("record") })
+			})
+		}()
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("got records still held long after the give up time, wanted all of them failed")
+	}
+	close(errs)
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed != 4 {
+		t.Errorf("got %d failed records, wanted 4", failed)
+	}
+	// each failed record which was sent has the failure line of its last attempt.
+	if got, wanted := strings.Count(stats.String(), "[ FAILURE ]"), int(atomic.LoadInt32(&attempted)); got != wanted {
+		t.Errorf("got %d failure lines, wanted %d:\n%s", got, wanted, stats.String())
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+// This file contains the capture mode used to debug refused submissions. With the -capture option, the
+// whole http exchange of each failed API call (and of a sample of the successful ones) is saved as one json
+// line into the captures.jsonl file of the work folder: method, url, headers with secrets redacted, body,
+// status, response headers and body and timing. Bodies and the file are size-capped. The replay-request
+// subcommand sends the captured requests again to check a fix of the backend or of a record.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the file inside the work folder where the exchanges are captured.
+const captureFilename = "captures.jsonl"
+
+// CaptureOptions holds the settings of the capture mode.
+type CaptureOptions struct {
+	// rate (0 to 1) of successful exchanges captured in addition to the failed ones.
+	Sample float64
+	// maximum number of bytes kept of each request and response body.
+	BodyLimit int
+	// maximum size in bytes of the captures file - further exchanges are dropped.
+	FileLimit int64
+}
+
+// if true then failed exchanges with the API are captured.
+var captureMode bool
+
+// settings of the capture mode of the current run.
+var captureOptions = CaptureOptions{BodyLimit: 64 << 10, FileLimit: 50 << 20}
+
+// writer of the captured exchanges - nil when disabled.
+var capturer *Capturer
+
+// An Exchange is a captured http call to the API.
+type Exchange struct {
+	CID             string            `json:"cid"`
+	Time            time.Time         `json:"time"`
+	Method          string            `json:"method"`
+	URL             string            `json:"url"`
+	RequestHeaders  map[string]string `json:"request_headers"`
+	RequestBody     string            `json:"request_body"`
+	Status          int               `json:"status,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	ResponseBody    string            `json:"response_body,omitempty"`
+	DurationMs      float64           `json:"duration_ms"`
+	Error           string            `json:"error,omitempty"`
+	Outcome         string            `json:"outcome"`
+	// true when a body exceeded the limit and was cut.
+	RequestTruncated  bool `json:"request_truncated,omitempty"`
+	ResponseTruncated bool `json:"response_truncated,omitempty"`
+}
+
+// A Capturer writes the exchanges into the captures file. It is safe for concurrent use by workers.
+type Capturer struct {
+	opts CaptureOptions
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	saved   int
+	dropped int
+}
+
+// newCapturer is a function that creates the captures file into the work folder.
+func newCapturer(folder string, opts CaptureOptions) (*Capturer, error) {
+	f, err := os.Create(filepath.Join(folder, captureFilename))
+	if err != nil {
+		return nil, err
+	}
+	return &Capturer{opts: opts, file: f}, nil
+}
+
+// limitBody is a function that cuts a body to the limit. It returns true when the body was cut.
+func limitBody(body []byte, limit int) (string, bool) {
+	if limit > 0 && len(body) > limit {
+		return string(body[:limit]), true
+	}
+	return string(body), false
+}
+
+// Start begins the capture of a request which is about to be sent.
+func (c *Capturer) Start(cid string, request *http.Request, body []byte) *Exchange {
+	e := &Exchange{
+		CID:            cid,
+		Time:           time.Now().UTC(),
+		Method:         request.Method,
+		URL:            redactURL(request.URL),
+		RequestHeaders: redactHeaders(request.Header),
+	}
+	e.RequestBody, e.RequestTruncated = limitBody(body, c.opts.BodyLimit)
+	return e
+}
+
+// Response adds the response or the error of the call to the exchange. The response body is read up
+// to the limit then given back to the response so that the caller could still decode it.
+func (c *Capturer) Response(e *Exchange, response *http.Response, err error, d time.Duration) {
+	e.DurationMs = float64(d) / float64(time.Millisecond)
+	if err != nil {
+		e.Error = redactError(err)
+		return
+	}
+	e.Status = response.StatusCode
+	e.ResponseHeaders = redactHeaders(response.Header)
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, int64(c.opts.BodyLimit)+1))
+	response.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+	e.ResponseBody, e.ResponseTruncated = limitBody(body, c.opts.BodyLimit)
+}
+
+// Save writes the exchange when the call failed or when it is part of the sample of successful calls.
+func (c *Capturer) Save(e *Exchange, err error) {
+	if err == nil || err == errResourceNotFound {
+		if c.opts.Sample <= 0 || rand.Float64() >= c.opts.Sample {
+			return
+		}
+		e.Outcome = "success"
+		if err != nil {
+			e.Outcome = err.Error()
+		}
+	} else {
+		e.Outcome = err.Error()
+	}
+
+	data, merr := json.Marshal(e)
+	if merr != nil {
+		return
+	}
+	data = append(data, '\n')
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts.FileLimit > 0 && c.size+int64(len(data)) > c.opts.FileLimit {
+		if c.dropped == 0 {
+			logError.Printf("captures file reached its limit of %d bytes - next exchanges are dropped.\n", c.opts.FileLimit)
+		}
+		c.dropped++
+		return
+	}
+	n, _ := c.file.Write(data)
+	c.size += int64(n)
+	c.saved++
+}
+
+// Close closes the captures file and returns the number of saved and dropped exchanges.
+func (c *Capturer) Close() (int, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saved, c.dropped, c.file.Close()
+}
+
+// setupCapture is a function that creates the captures file of the work folder when enabled.
+func setupCapture() {
+	if !captureMode {
+		return
+	}
+	var err error
+	if capturer, err = newCapturer(workFolder, captureOptions); err != nil {
+		fmt.Print("\n\t[+] creating the captures file ... [ FAILURE ]\n\n\t[-] please check log file for more detailed reason. // ")
+		logError.Fatalf("failed to create the captures file - Errmsg: %v", err)
+	}
+	logInfos.Printf("capture of failed exchanges into %s enabled (sample of successful ones: %g).\n", captureFilename, captureOptions.Sample)
+}
+
+// closeCapture is a function that closes the captures file and logs how many exchanges it holds.
+func closeCapture() {
+	if capturer == nil {
+		return
+	}
+	saved, dropped, err := capturer.Close()
+	if err != nil {
+		logError.Printf("failed to close the captures file - Errmsg: %v", err)
+	}
+	logInfos.Printf("%d exchanges captured into %s - %d dropped over the size limit.\n", saved, captureFilename, dropped)
+	capturer = nil
+}
+
+const replayUsage = `Usage:
+
+    eprocessor replay-request <captures.jsonl | work folder> [replay options]
+
+Replay options:
+    -cid      Call id (cid) of the exchange to replay - all captured exchanges by default.
+    -key      Value of the API key restoring the redacted X-API-KEY header and url query values
+              (default EPROCESSOR_API_KEY). Other redacted headers are not sent.
+    -url      Url replacing the captured one (e.g. a staging api).
+    -timeout  Maximum time to wait for each response (default 30s).
+
+Exchanges with a truncated request body are not replayed. The exit code is 0 when all replayed
+requests succeed, 3 when some of them fail and 4 when all of them fail.
+`
+
+// loadExchanges is a function that reads the exchanges of a captures file or of the captures file of
+// a work folder.
+func loadExchanges(path string) ([]Exchange, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, captureFilename)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var exchanges []Exchange
+	for n, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var e Exchange
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		exchanges = append(exchanges, e)
+	}
+	return exchanges, nil
+}
+
+// replayRequest is a function that sends a captured request again. Redacted headers are restored
+// with the key when they hold the API key and dropped otherwise. Redacted url query values are
+// restored with the key.
+func replayRequest(client *http.Client, e Exchange, key, target string) (*http.Response, error) {
+	if e.RequestTruncated {
+		return nil, fmt.Errorf("request body was truncated at capture")
+	}
+	if target == "" {
+		target = e.URL
+		if u, err := url.Parse(target); err == nil && strings.Contains(u.RawQuery, redacted) {
+			query := u.Query()
+			for _, values := range query {
+				for i, value := range values {
+					if value == redacted {
+						values[i] = key
+					}
+				}
+			}
+			u.RawQuery = query.Encode()
+			target = u.String()
+		}
+	}
+	request, err := http.NewRequest(e.Method, target, strings.NewReader(e.RequestBody))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range e.RequestHeaders {
+		if value == redacted {
+			if http.CanonicalHeaderKey(name) != "X-Api-Key" {
+				continue
+			}
+			value = key
+		}
+		request.Header.Set(name, value)
+	}
+	return client.Do(request)
+}
+
+// runReplay is a function that replays the captured exchanges and prints the new outcome of each one.
+// It returns the exit code of the program.
+func runReplay(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintf(os.Stderr, "%s\n", replayUsage)
+		return exitCodeConfig
+	}
+	fs := flag.NewFlagSet("replay-request", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", replayUsage) }
+	cid := fs.String("cid", "", "")
+	key := fs.String("key", os.Getenv("EPROCESSOR_API_KEY"), "")
+	target := fs.String("url", "", "")
+	wait := fs.Duration("timeout", 30*time.Second, "")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 {
+		return exitCodeConfig
+	}
+
+	exchanges, err := loadExchanges(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nFailed to load the captured exchanges - Errmsg: %v\n", err)
+		return exitCodeConfig
+	}
+	if *cid != "" {
+		var selected []Exchange
+		for _, e := range exchanges {
+			if e.CID == *cid {
+				selected = append(selected, e)
+			}
+		}
+		exchanges = selected
+	}
+	if len(exchanges) == 0 {
+		fmt.Fprint(os.Stderr, "\nNo captured exchange to replay.\n")
+		return exitCodeConfig
+	}
+
+	client := &http.Client{Timeout: *wait}
+	var success, failed int64
+	for _, e := range exchanges {
+		start := time.Now()
+		response, err := replayRequest(client, e, *key, *target)
+		if err != nil {
+			failed++
+			fmt.Printf("[cid: %s] %s %s - captured: %s / replayed: Errmsg: %v\n", e.CID, e.Method, e.URL, e.Outcome, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		response.Body.Close()
+		if response.StatusCode < 300 {
+			success++
+		} else {
+			failed++
+		}
+		fmt.Printf("[cid: %s] %s %s - captured: %s / replayed: %d in %s %s\n", e.CID, e.Method, response.Request.URL, e.Outcome, response.StatusCode, time.Since(start).Round(time.Millisecond), strings.TrimSpace(string(body)))
+	}
+	fmt.Printf("\n%d replayed / success: %d / fails: %d\n", success+failed, success, failed)
+	return exitCodeOf(exitStatusOf(success, failed))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCaptureAndReplay(t *testing.T) {
+	_, _, restore := captureLoggers()
+	defer restore()
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var refuse int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-KEY") != "my-key" || r.URL.Query().Get("token") != "my-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if atomic.LoadInt32(&refuse) == 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":400,"error":"invalid amount` + strings.Repeat(".", 100) + `"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	defer func(api, key string, m *Metrics, c *Capturer) { apiURL, apiKEY, metrics, capturer = api, key, m, c }(apiURL, apiKEY, metrics, capturer)
+	apiURL, apiKEY, metrics = server.URL+"?token=my-key", "my-key", newMetrics()
+	if capturer, err = newCapturer(dir, CaptureOptions{BodyLimit: 64}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the refused record is captured but not the successful one without sampling.
+	if err := postPaymentRecord(http.MethodPost, apiURL, []byte(`{"PaymentRecord":{}}`), ""); err == nil {
+		t.Fatal("refused record reported as success")
+	}
+	atomic.StoreInt32(&refuse, 0)
+	if err := postPaymentRecord(http.MethodPost, apiURL, []byte(`{"PaymentRecord":{}}`), ""); err != nil {
+		t.Fatalf("got %v for the accepted record, wanted nil", err)
+	}
+	if saved, dropped, err := capturer.Close(); saved != 1 || dropped != 0 || err != nil {
+		t.Fatalf("got %d saved / %d dropped / %v, wanted 1 saved", saved, dropped, err)
+	}
+
+	exchanges, err := loadExchanges(dir)
+	if err != nil || len(exchanges) != 1 {
+		t.Fatalf("got %d exchanges / %v, wanted 1 exchange", len(exchanges), err)
+	}
+	e := exchanges[0]
+	if e.Status != http.StatusBadRequest || e.Outcome != "api status 400" || e.RequestHeaders["X-Api-Key"] != redacted || e.URL != server.URL+"?token="+redacted ||
+		e.RequestBody != `{"PaymentRecord":{}}` || !e.ResponseTruncated || len(e.ResponseBody) != 64 || e.ResponseHeaders["Content-Type"] != "application/json" {
+		t.Errorf("got exchange %+v", e)
+	}
+
+	// the redacted key and query value are restored from the replay option.
+	response, err := replayRequest(http.DefaultClient, e, "my-key", "")
+	if err != nil || response.StatusCode != http.StatusCreated {
+		t.Fatalf("got %v / %v, wanted 201 response", response, err)
+	}
+	response.Body.Close()
+
+	e.RequestTruncated = true
+	if _, err := replayRequest(http.DefaultClient, e, "my-key", ""); err == nil {
+		t.Error("truncated request replayed")
+	}
+}
+
+func TestPostPaymentRecordGatewayBody(t *testing.T) {
+	_, stats, restore := captureLoggers()
+	defer restore()
+
+	// a gateway answers with a json body without status nor error.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	defer func(api, key string, m *Metrics, c *Capturer) { apiURL, apiKEY, metrics, capturer = api, key, m, c }(apiURL, apiKEY, metrics, capturer)
+	apiURL, apiKEY, metrics, capturer = server.URL, "my-key", newMetrics(), nil
+	if err := postPaymentRecord(http.MethodPost, apiURL, []byte(`{"PaymentRecord":{}}`), ""); err == nil || err.Error() != "api status 500" {
+		t.Errorf("got %v, wanted api status 500", err)
+	}
+	if !strings.Contains(stats.String(), "[ FAILURE ]") {
+		t.Errorf("got statistics %q, wanted a failure line", stats.String())
+	}
+}
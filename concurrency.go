@@ -0,0 +1,191 @@
+package main
+
+// This file contains the adaptive concurrency of the submission. A fixed number of workers is either too
+// slow or overloads the API depending on the time of day. With the -adaptive option, an AIMD controller
+// (additive increase, multiplicative decrease) checks the API calls of each interval: the number of workers
+// allowed to send at the same time grows by one while the calls are healthy and is halved as soon as the
+// API answers 429 or 5xx, does not answer or when the p95 latency rises above the target (twice the baseline
+// p95 when no target is set). The baseline is the best p95 observed which slowly rises while the latency stays
+// higher, so a lasting slowdown of the API does not keep the workers at the minimum. Each change is logged and
+// displayed with the progression.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// if true then the number of active workers follows the health of the API.
+var adaptiveMode bool
+
+// ConcurrencyOptions holds the settings of the adaptive concurrency.
+type ConcurrencyOptions struct {
+	// lowest and highest number of workers sending at the same time.
+	Min, Max int
+	// p95 latency above which the concurrency decreases - twice the best observed p95 when 0.
+	TargetP95 time.Duration
+	// time between two adjustments.
+	Interval time.Duration
+}
+
+// settings of the adaptive concurrency of the current run.
+var concurrencyOptions = ConcurrencyOptions{Min: 1, Max: 50, Interval: time.Second}
+
+// adaptive concurrency of the current submission. It holds a *Concurrency which is stored by the
+// submission and loaded by the workers, the metrics and the progression.
+var concurrency atomic.Value
+
+// share of the gap to a higher p95 by which the baseline rises at each interval.
+const baselineRise = 0.1
+
+// currentConcurrency is a function that returns the adaptive concurrency of the current submission - nil when disabled.
+func currentConcurrency() *Concurrency {
+	c, _ := concurrency.Load().(*Concurrency)
+	return c
+}
+
+// A Concurrency limits the number of workers sending at the same time and adjusts this limit from
+// the API calls observed during each interval. It is safe for concurrent use by workers.
+type Concurrency struct {
+	opts ConcurrencyOptions
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+	// calls of the current interval.
+	latencies  []time.Duration
+	overloaded int
+	// best p95 latency of the intervals - rises toward higher p95 by baselineRise at each interval.
+	baseline time.Duration
+	changes  int
+}
+
+// newConcurrency is a function that creates the controller with the given initial limit kept within bounds.
+func newConcurrency(opts ConcurrencyOptions, initial int) *Concurrency {
+	c := &Concurrency{opts: opts, limit: clampLimit(initial, opts)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// clampLimit is a function that keeps a limit between the minimum and the maximum of the options.
+func clampLimit(limit int, opts ConcurrencyOptions) int {
+	if limit < opts.Min {
+		return opts.Min
+	}
+	if limit > opts.Max {
+		return opts.Max
+	}
+	return limit
+}
+
+// Acquire blocks until the worker is allowed to send a record.
+func (c *Concurrency) Acquire() {
+	c.mu.Lock()
+	for c.active >= c.limit {
+		c.cond.Wait()
+	}
+	c.active++
+	c.mu.Unlock()
+}
+
+// Release frees the place of a worker which sent its record.
+func (c *Concurrency) Release() {
+	c.mu.Lock()
+	c.active--
+	c.mu.Unlock()
+	c.cond.Signal()
+}
+
+// Limit returns the number of workers allowed to send at the same time.
+func (c *Concurrency) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+// Changes returns the number of times the limit changed.
+func (c *Concurrency) Changes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changes
+}
+
+// Observe records an API call by its status code. Calls which did not get any response use the "error" code.
+func (c *Concurrency) Observe(code string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latencies = append(c.latencies, d)
+	if code == "error" || code == "429" || strings.HasPrefix(code, "5") {
+		c.overloaded++
+	}
+}
+
+// Adjust computes the new limit from the calls of the ending interval. It returns the previous and
+// the new limits with the reason of the change - an empty reason when nothing was observed.
+func (c *Concurrency) Adjust() (int, int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.limit
+	if len(c.latencies) == 0 {
+		return previous, previous, ""
+	}
+
+	sort.Slice(c.latencies, func(i, j int) bool { return c.latencies[i] < c.latencies[j] })
+	p95 := time.Duration(percentile(c.latencies, 95) * float64(time.Millisecond))
+	target := c.opts.TargetP95
+	if target == 0 && c.baseline > 0 {
+		target = 2 * c.baseline
+	}
+
+	var reason string
+	switch {
+	case c.overloaded > 0:
+		c.limit, reason = previous/2, fmt.Sprintf("%d overloaded calls", c.overloaded)
+	case target > 0 && p95 > target:
+		c.limit, reason = previous/2, fmt.Sprintf("p95 %s above %s", p95.Round(time.Millisecond), target.Round(time.Millisecond))
+	default:
+		c.limit, reason = previous+1, fmt.Sprintf("healthy p95 %s", p95.Round(time.Millisecond))
+	}
+	c.limit = clampLimit(c.limit, c.opts)
+	if c.baseline == 0 || p95 < c.baseline {
+		c.baseline = p95
+	} else {
+		c.baseline += time.Duration(float64(p95-c.baseline) * baselineRise)
+	}
+	c.latencies, c.overloaded = c.latencies[:0], 0
+
+	if c.limit != previous {
+		c.changes++
+		c.cond.Broadcast()
+	}
+	return previous, c.limit, reason
+}
+
+// Run adjusts the limit at each interval until stop is closed and logs each change.
+func (c *Concurrency) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if previous, limit, reason := c.Adjust(); limit != previous {
+				logInfos.Printf("concurrency changed from %d to %d workers - %s.\n", previous, limit, reason)
+			}
+		}
+	}
+}
+
+// workersInfo is a function that returns the number of active workers shown with the progression.
+func workersInfo() string {
+	c := currentConcurrency()
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf(" [workers: %d]", c.Limit())
+}
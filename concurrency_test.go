@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyAdjust(t *testing.T) {
+	c := newConcurrency(ConcurrencyOptions{Min: 2, Max: 5, Interval: time.Second}, 10)
+	if c.Limit() != 5 {
+		t.Fatalf("got initial limit %d, wanted the maximum 5", c.Limit())
+	}
+
+	steps := []struct {
+		codes   []string
+		latency time.Duration
+		want    int
+	}{
+		// nothing observed keeps the limit.
+		{nil, 0, 5},
+		// a 429 response halves the limit.
+		{[]string{"200", "429"}, 10 * time.Millisecond, 2},
+		// healthy calls add one worker at a time.
+		{[]string{"200", "201"}, 10 * time.Millisecond, 3},
+		{[]string{"200"}, 12 * time.Millisecond, 4},
+		// p95 above twice the baseline p95 backs off.
+		{[]string{"200", "200"}, 30 * time.Millisecond, 2},
+		// api errors back off but never below the minimum.
+		{[]string{"error"}, time.Second, 2},
+	}
+	for i, step := range steps {
+		for _, code := range step.codes {
+			c.Observe(code, step.latency)
+		}
+		if _, got, _ := c.Adjust(); got != step.want {
+			t.Errorf("step %d: got limit %d, wanted %d", i, got, step.want)
+		}
+	}
+
+	fixed := newConcurrency(ConcurrencyOptions{Min: 1, Max: 10, TargetP95: 50 * time.Millisecond}, 4)
+	fixed.Observe("200", 40*time.Millisecond)
+	if _, got, _ := fixed.Adjust(); got != 5 {
+		t.Errorf("got limit %d under the target p95, wanted 5", got)
+	}
+	fixed.Observe("200", 60*time.Millisecond)
+	if _, got, reason := fixed.Adjust(); got != 2 || reason == "" {
+		t.Errorf("got limit %d (%s) above the target p95, wanted 2", got, reason)
+	}
+}
+
+func TestConcurrencyBaselineRises(t *testing.T) {
+	c := newConcurrency(ConcurrencyOptions{Min: 1, Max: 50}, 8)
+	c.Observe("200", 10*time.Millisecond)
+	c.Adjust()
+
+	// a lasting slowdown backs off first then the baseline follows and the workers grow again.
+	var limits []int
+	for i := 0; i < 5; i++ {
+		c.Observe("200", 25*time.Millisecond)
+		_, limit, _ := c.Adjust()
+		limits = append(limits, limit)
+	}
+	if limits[0] != 4 || limits[len(limits)-1] <= limits[len(limits)-2] {
+		t.Errorf("got limits %v, wanted a back off followed by growth", limits)
+	}
+}
+
+func TestCurrentConcurrency(t *testing.T) {
+	defer concurrency.Store((*Concurrency)(nil))
+	if c := currentConcurrency(); c != nil {
+		t.Fatalf("got %v, wanted nil before the submission", c)
+	}
+	c := newConcurrency(ConcurrencyOptions{Min: 1, Max: 4}, 3)
+	concurrency.Store(c)
+	if got := workersInfo(); got != " [workers: 3]" {
+		t.Errorf("got %q, wanted \" [workers: 3]\"", got)
+	}
+	concurrency.Store((*Concurrency)(nil))
+	if got := workersInfo(); got != "" {
+		t.Errorf("got %q, wanted no workers info", got)
+	}
+}
+
+func TestConcurrencyLimitsWorkers(t *testing.T) {
+	c := newConcurrency(ConcurrencyOptions{Min: 1, Max: 8}, 3)
+	var active, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 5; n++ {
+				c.Acquire()
+				if a := atomic.AddInt32(&active, 1); a > atomic.LoadInt32(&peak) {
+					atomic.StoreInt32(&peak, a)
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&active, -1)
+				c.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	if peak > 3 {
+		t.Errorf("got %d workers sending at the same time, wanted at most 3", peak)
+	}
+}
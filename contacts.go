@@ -0,0 +1,202 @@
+package main
+
+// This file contains the contacts normalization stage. The Telephone and Mobile fields are formatted
+// into E.164 using the country taken from the State field (or the default country) and the Zipcode
+// field is checked against the postal code pattern of that country. Anything which does not match
+// is not rejected but flagged into the quality.csv data-quality report of the work folder.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// name of the file inside the work folder where data-quality issues are saved.
+const qualityFilename = "quality.csv"
+
+// A countryRule describes the phone numbering and postal code format of a country.
+type countryRule struct {
+	// international calling code without the plus sign.
+	callingCode string
+	// national trunk prefix to drop before adding the calling code.
+	trunkPrefix string
+	// allowed range of digits of the national significant number.
+	minDigits, maxDigits int
+	// expected format of the postal code.
+	postalCode *regexp.Regexp
+}
+
+// map of ISO 3166 alpha-2 country codes to their rules.
+var countryRules = map[string]countryRule{
+	"US": {"1", "1", 10, 10, regexp.MustCompile(`^\d{5}(-\d{4})?$`)},
+	"CA": {"1", "1", 10, 10, regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`)},
+	"GB": {"44", "0", 9, 10, regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`)},
+	"FR": {"33", "0", 9, 9, regexp.MustCompile(`^\d{5}$`)},
+	"DE": {"49", "0", 6, 11, regexp.MustCompile(`^\d{5}$`)},
+	"ES": {"34", "", 9, 9, regexp.MustCompile(`^\d{5}$`)},
+	"IT": {"39", "", 6, 11, regexp.MustCompile(`^\d{5}$`)},
+	"NL": {"31", "0", 9, 9, regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`)},
+	"BE": {"32", "0", 8, 9, regexp.MustCompile(`^\d{4}$`)},
+	"CH": {"41", "0", 9, 9, regexp.MustCompile(`^\d{4}$`)},
+	"PL": {"48", "", 9, 9, regexp.MustCompile(`^\d{2}-\d{3}$`)},
+}
+
+// map of country names which could be found into the State field to their ISO code.
+var countryNames = map[string]string{
+	"UNITED STATES":  "US",
+	"USA":            "US",
+	"CANADA":         "CA",
+	"UNITED KINGDOM": "GB",
+	"UK":             "GB",
+	"FRANCE":         "FR",
+	"GERMANY":        "DE",
+	"SPAIN":          "ES",
+	"ITALY":          "IT",
+	"NETHERLANDS":    "NL",
+	"BELGIUM":        "BE",
+	"SWITZERLAND":    "CH",
+	"POLAND":         "PL",
+	// ISO 3166 alpha-3 codes are explicit where alpha-2 ones clash with US states (CA, DE).
+	"CAN": "CA",
+	"GBR": "GB",
+	"FRA": "FR",
+	"DEU": "DE",
+	"ESP": "ES",
+	"ITA": "IT",
+	"NLD": "NL",
+	"BEL": "BE",
+	"CHE": "CH",
+	"POL": "PL",
+}
+
+// list of US states abbreviations. They win over the country codes they clash with so that CA is
+// California and DE is Delaware.
+var usStates = " AL AK AZ AR CA CO CT DE FL GA HI ID IL IN IA KS KY LA ME MD MA MI MN MS MO MT NE NV NH NJ NM NY NC ND OH OK OR PA RI SC SD TN TX UT VT VA WA WV WI WY DC "
+
+// A qualityIssue is a data-quality problem found on a field of a record.
+type qualityIssue struct {
+	record []string
+	field  string
+	value  string
+	issue  string
+}
+
+// countryOf is a function that deduces the country from the State field. The value could be a
+// US state, a country code or a country name. Two letters values are taken as US states first so
+// Canada and Germany need their name or their alpha-3 code (CAN, DEU). Otherwise the default country
+// is returned.
+func countryOf(state, defaultCountry string) string {
+	s := strings.ToUpper(strings.TrimSpace(state))
+	if len(s) == 2 && strings.Contains(usStates, " "+s+" ") {
+		return "US"
+	}
+	if _, ok := countryRules[s]; ok {
+		return s
+	}
+	if code, ok := countryNames[s]; ok {
+		return code
+	}
+	// could be the name of a region like "Lesser Poland".
+	for name, code := range countryNames {
+		if strings.HasSuffix(s, " "+name) {
+			return code
+		}
+	}
+	return strings.ToUpper(defaultCountry)
+}
+
+// FormatE164 is a function that formats a phone number into E.164 like +48123456789. Numbers
+// already written with an international prefix (+ or 00) keep their own country calling code.
+func FormatE164(phone, country string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+
+	// country calling codes never start with zero so 000... is a national number.
+	international := strings.HasPrefix(digits, "00") && len(digits) > 2 && digits[2] != '0'
+	if strings.HasPrefix(strings.TrimSpace(phone), "+") || international {
+		digits = strings.TrimPrefix(digits, "00")
+		if len(digits) < 8 || len(digits) > 15 {
+			return "", fmt.Errorf("international number %q must have between 8 and 15 digits", phone)
+		}
+		return "+" + digits, nil
+	}
+
+	rule, ok := countryRules[country]
+	if !ok {
+		return "", fmt.Errorf("no phone numbering rule for country %q", country)
+	}
+	if rule.trunkPrefix != "" && len(digits) > rule.maxDigits && strings.HasPrefix(digits, rule.trunkPrefix) {
+		digits = strings.TrimPrefix(digits, rule.trunkPrefix)
+	}
+	if len(digits) < rule.minDigits || len(digits) > rule.maxDigits {
+		return "", fmt.Errorf("national number %q does not match %s numbering (%d to %d digits)", phone, country, rule.minDigits, rule.maxDigits)
+	}
+	return "+" + rule.callingCode + digits, nil
+}
+
+// ValidatePostalCode is a function that checks the postal code against the pattern of the country.
+func ValidatePostalCode(zipcode, country string) error {
+	rule, ok := countryRules[country]
+	if !ok {
+		return fmt.Errorf("no postal code rule for country %q", country)
+	}
+	if !rule.postalCode.MatchString(strings.ToUpper(strings.TrimSpace(zipcode))) {
+		return fmt.Errorf("postal code %q does not match %s format", zipcode, country)
+	}
+	return nil
+}
+
+// NormalizeContacts is a function that formats the Telephone and Mobile fields of each record into
+// E.164 and validates the Zipcode field against the country of the record. Fields which could not be
+// normalized are kept unchanged and reported as data-quality issues. Missing values are skipped.
+func NormalizeContacts(records [][]string, defaultCountry string) []qualityIssue {
+	var issues []qualityIssue
+	for _, record := range records {
+		country := countryOf(record[5], defaultCountry)
+
+		if !isMissing(record[6]) {
+			if err := ValidatePostalCode(record[6], country); err != nil {
+				issues = append(issues, qualityIssue{record: record, field: "Zipcode", value: record[6], issue: err.Error()})
+			}
+		}
+
+		for i, field := range []string{"Telephone", "Mobile"} {
+			// telephone and mobile are the 8th and 9th fields.
+			value := record[7+i]
+			if isMissing(value) {
+				continue
+			}
+			phone, err := FormatE164(value, country)
+			if err != nil {
+				issues = append(issues, qualityIssue{record: record, field: field, value: value, issue: err.Error()})
+				continue
+			}
+			record[7+i] = phone
+		}
+	}
+	return issues
+}
+
+// saveQualityReport is a function that writes the data-quality issues into the quality.csv
+// file of the work folder. Each line identifies the record by its Date, Name and State fields.
+func saveQualityReport(folder string, issues []qualityIssue) error {
+	f, err := os.Create(folder + string(os.PathSeparator) + qualityFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"Date", "Name", "State", "Field", "Value", "Issue"})
+	for _, i := range issues {
+		w.Write([]string{i.record[0], i.record[1], i.record[5], i.field, i.value, i.issue})
+	}
+	w.Flush()
+	return w.Error()
+}
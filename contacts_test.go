@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFormatE164(t *testing.T) {
+	casesTable := []struct {
+		phone   string
+		country string
+		want    string
+	}{
+		{"504-319-6911", "US", "+15043196911"},
+		{"1 (504) 319-6911", "US", "+15043196911"},
+		{"+48 123 456 789", "US", "+48123456789"},
+		{"0048 123 456 789", "US", "+48123456789"},
+		{"123 456 789", "PL", "+48123456789"},
+		{"01 23 45 67 89", "FR", "+33123456789"},
+	}
+
+	for _, c := range casesTable {
+		got, err := FormatE164(c.phone, c.country)
+		if err != nil || got != c.want {
+			t.Errorf("formatting of %q for %s was incorrect, got: %q (err: %v), wanted %q", c.phone, c.country, got, err, c.want)
+		}
+	}
+
+	// US style number does not fit polish numbering.
+	if _, err := FormatE164("000-000-0000", "PL"); err == nil {
+		t.Errorf("formatting of US style number for PL should have failed")
+	}
+}
+
+func TestCountryOf(t *testing.T) {
+	casesTable := []struct {
+		state string
+		want  string
+	}{
+		{"CA", "US"},
+		{"DE", "US"},
+		{"tx", "US"},
+		{"PL", "PL"},
+		{"Canada", "CA"},
+		{"DEU", "DE"},
+		{"Lesser Poland", "PL"},
+		{"missing", "FR"},
+	}
+
+	for _, c := range casesTable {
+		if got := countryOf(c.state, "FR"); got != c.want {
+			t.Errorf("country of state %q was incorrect, got: %s, wanted %s", c.state, got, c.want)
+		}
+	}
+
+	// Delaware and California numbers are US numbers.
+	for _, state := range []string{"DE", "CA"} {
+		if got, err := FormatE164("302-555-0100", countryOf(state, "PL")); err != nil || got != "+13025550100" {
+			t.Errorf("formatting for state %s was incorrect, got: %q (err: %v), wanted +13025550100", state, got, err)
+		}
+	}
+}
+
+func TestNormalizeContacts(t *testing.T) {
+	input := [][]string{
+		{"01/04/2016", "Jerome AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$90", "Stripe", "08/04/2021"},
+		{"01/04/2016", "Abou AMON", "Poland Street", "missing", "Warsaw", "Lesser Poland", "30-001", "missing", "601 234 567", "$90", "Stripe", "08/04/2021"},
+		{"01/04/2016", "John DOE", "Main Street", "missing", "Austin", "TX", "73301", "(512) 555-0100", "missing", "$90", "Stripe", "08/04/2021"},
+	}
+
+	issues := NormalizeContacts(input, "US")
+	// first record has a US style zipcode and mobile with a PL state.
+	if len(issues) != 2 || issues[0].field != "Zipcode" || issues[1].field != "Mobile" {
+		t.Fatalf("got %v issues, wanted Zipcode and Mobile issues of the first record", issues)
+	}
+	if input[1][8] != "+48601234567" || input[2][7] != "+15125550100" {
+		t.Errorf("got phones %q and %q, wanted +48601234567 and +15125550100", input[1][8], input[2][7])
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) did not fail", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2021, time.October, 15, 10, 7, 30, 0, time.UTC) // friday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2021, 10, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2021, 10, 15, 10, 15, 0, 0, time.UTC)},
+		{"0,30 9-17 * * *", time.Date(2021, 10, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 */6 * * *", time.Date(2021, 10, 15, 12, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2021, 10, 16, 0, 0, 0, 0, time.UTC)},
+		{"30 8 * * 1-5", time.Date(2021, 10, 18, 8, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2021, 10, 17, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// restricted day of month and day of week match any of them.
+		{"0 0 20 * 6", time.Date(2021, 10, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := c.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: got next %v, wanted %v", tt.expr, got, tt.want)
+		}
+	}
+}
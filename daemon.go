@@ -0,0 +1,416 @@
+package main
+
+// This file contains the daemon subcommand. The daemon stays up and starts a run of the pipeline at each
+// tick of a fixed interval or of a cron expression. Each run is a child process of the program into batch
+// mode so it keeps its own work folder, summary and exit code and a fatal error never stops the daemon.
+// A tick happening while the previous run is still going is skipped so runs never overlap. The health
+// and the status of the last run are served over http and a SIGTERM lets the current run finish before
+// the daemon stops.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const daemonUsage = `Usage:
+
+    eprocessor daemon (-every <interval> | -cron <expression>) [daemon options] [-- pipeline options]
+
+Daemon options:
+    -every             Fixed interval between two runs (e.g. 30m, 6h).
+    -cron              Five fields cron expression (e.g. '0 */6 * * *') or @hourly, @daily, @weekly, @monthly.
+    -health-addr       Address where /health and /status are served (default :8081) - empty disables it.
+    -shutdown-timeout  Maximum time to wait for the current run on SIGTERM before killing it (default 5m).
+    -run-now           Start a first run immediately instead of waiting for the first tick.
+
+Pipeline options are the options of a normal run (e.g. -api, -key, -source, -sinks). When none is
+provided each run loads them from the EPROCESSOR_* environment variables. Runs are always in batch mode.
+`
+
+// runStatus describes the outcome of a run started by the daemon.
+type runStatus struct {
+	Number     int         `json:"number"`
+	Start      time.Time   `json:"start"`
+	End        time.Time   `json:"end"`
+	WorkFolder string      `json:"work_folder,omitempty"`
+	ExitCode   int         `json:"exit_code"`
+	ExitStatus string      `json:"exit_status"`
+	Error      string      `json:"error,omitempty"`
+	Summary    *RunSummary `json:"summary,omitempty"`
+}
+
+// daemonStatus is the state of the daemon served on the /status route.
+type daemonStatus struct {
+	Status   string     `json:"status"`
+	Started  time.Time  `json:"started"`
+	Running  bool       `json:"running"`
+	Runs     int        `json:"runs"`
+	Skipped  int        `json:"skipped_ticks"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	Current  *time.Time `json:"current_run_start,omitempty"`
+	LastRun  *runStatus `json:"last_run,omitempty"`
+	Schedule string     `json:"schedule"`
+}
+
+// A Daemon starts runs at each tick of its schedule and never lets two runs overlap.
+type Daemon struct {
+	schedule Schedule
+	// description of the schedule for the status.
+	spec string
+	// executes one run until its end or the cancellation of the context.
+	run    func(ctx context.Context, number int) runStatus
+	logger *log.Logger
+
+	mu       sync.Mutex
+	started  time.Time
+	running  bool
+	current  time.Time
+	stopping bool
+	runs     int
+	skipped  int
+	next     time.Time
+	last     *runStatus
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// newDaemon is a function that creates a daemon which executes the run function on the schedule.
+func newDaemon(schedule Schedule, spec string, run func(ctx context.Context, number int) runStatus, logger *log.Logger) *Daemon {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Daemon{schedule: schedule, spec: spec, run: run, logger: logger, started: time.Now(), ctx: ctx, cancel: cancel}
+}
+
+// Trigger starts a run into background unless a run is already going. It reports if the run started.
+func (d *Daemon) Trigger() bool {
+	d.mu.Lock()
+	if d.running || d.stopping {
+		d.skipped++
+		d.mu.Unlock()
+		d.logger.Printf("tick skipped - the run started at %s is still going.\n", d.current.Format(time.RFC3339))
+		return false
+	}
+	d.running, d.current = true, time.Now()
+	d.runs++
+	number := d.runs
+	d.wg.Add(1)
+	d.mu.Unlock()
+
+	go func() {
+		defer d.wg.Done()
+		d.logger.Printf("run #%d started.\n", number)
+		status := d.run(d.ctx, number)
+		d.logger.Printf("run #%d ended with %s status (exit code %d) into %q.\n", number, status.ExitStatus, status.ExitCode, status.WorkFolder)
+		d.mu.Lock()
+		d.running, d.last = false, &status
+		d.mu.Unlock()
+	}()
+	return true
+}
+
+// Loop triggers a run at each tick of the schedule until the stop channel is closed. Ticks are
+// computed from the previous one so a long run does not shift the next ones.
+func (d *Daemon) Loop(stop <-chan struct{}) {
+	tick := time.Now()
+	for {
+		next := d.schedule.Next(tick)
+		if next.IsZero() {
+			d.logger.Printf("no more run planned by the schedule %q.\n", d.spec)
+			<-stop
+			return
+		}
+		// do not try to catch up ticks missed while the host was suspended.
+		if now := time.Now(); next.Before(now) {
+			next = d.schedule.Next(now)
+		}
+		d.mu.Lock()
+		d.next = next
+		d.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		tick = next
+		d.Trigger()
+	}
+}
+
+// Shutdown prevents new runs and waits for the current run. The run is canceled when it does
+// not finish before the timeout. It reports if the run finished by itself.
+func (d *Daemon) Shutdown(timeout time.Duration) bool {
+	d.mu.Lock()
+	d.stopping = true
+	running := d.running
+	d.mu.Unlock()
+	if running {
+		d.logger.Printf("waiting up to %s for the current run to finish.\n", timeout)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		d.logger.Println("current run did not finish in time - killing it.")
+		d.cancel()
+		<-done
+		return false
+	}
+}
+
+// Status returns a snapshot of the state of the daemon.
+func (d *Daemon) Status() daemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := daemonStatus{Status: "ok", Started: d.started, Running: d.running, Runs: d.runs, Skipped: d.skipped, LastRun: d.last, Schedule: d.spec}
+	if d.stopping {
+		s.Status = "stopping"
+	}
+	if !d.next.IsZero() && !d.stopping {
+		next := d.next
+		s.NextRun = &next
+	}
+	if d.running {
+		current := d.current
+		s.Current = &current
+	}
+	return s
+}
+
+// ServeHTTP serves the health of the daemon on /health and its full status with the last run on
+// /status. Both answer 503 once the daemon is stopping so load balancers stop routing to it.
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := d.Status()
+	code := http.StatusOK
+	if s.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	var body interface{} = s
+	switch r.URL.Path {
+	case "/health":
+		body = map[string]interface{}{"status": s.Status, "running": s.Running, "uptime_seconds": int64(time.Since(s.Started).Seconds())}
+	case "/status":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
+
+// exitStatusOfCode is a function that returns the exit status matching an exit code of a run.
+func exitStatusOfCode(code int) string {
+	switch code {
+	case exitCodeSuccess:
+		return exitSuccess
+	case exitCodeConfig:
+		return "config_error"
+	case exitCodePartial:
+		return exitPartial
+	case exitCodeFailure:
+		return exitFailure
+	case exitCodeUnchanged:
+		return exitUnchanged
+	case exitCodeOutOfSync:
+		return exitOutOfSync
+	}
+	return exitError
+}
+
+// workFolders is a function that returns the set of the work folders of the current directory.
+func workFolders() map[string]bool {
+	set := make(map[string]bool)
+	folders, _ := filepath.Glob("log@*")
+	for _, folder := range folders {
+		set[folder] = true
+	}
+	return set
+}
+
+// newWorkFolder is a function that returns the work folder which is not part of the given set.
+func newWorkFolder(before map[string]bool) string {
+	folders, _ := filepath.Glob("log@*")
+	for _, folder := range folders {
+		if !before[folder] {
+			return folder
+		}
+	}
+	return ""
+}
+
+// complete fills the status with the end time and the exit code of the child process and with
+// the summary saved into its work folder.
+func (status *runStatus) complete(err error) {
+	status.End = time.Now()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr) && exitErr.ExitCode() > 0:
+		status.ExitCode = exitErr.ExitCode()
+	default:
+		status.ExitCode, status.Error = exitCodeError, err.Error()
+	}
+	status.ExitStatus = exitStatusOfCode(status.ExitCode)
+	if status.WorkFolder == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(status.WorkFolder, summaryFilename+".json"))
+	var s RunSummary
+	if err == nil && json.Unmarshal(data, &s) == nil {
+		status.Summary = &s
+		status.ExitStatus = s.ExitStatus
+		if status.Error == "" {
+			status.Error = s.Error
+		}
+	}
+}
+
+// time given to a canceled child to save its summary and exit after SIGTERM before being killed.
+var childGracePeriod = 10 * time.Second
+
+// childRun is a function that returns a run function which executes the program into batch mode
+// with the pipeline arguments. The work folder created by the child is found by comparing the work
+// folders before and after the run and its summary is attached to the status.
+func childRun(executable string, args []string) func(ctx context.Context, number int) runStatus {
+	args = append(append([]string(nil), args...), "-batch")
+	return func(ctx context.Context, number int) runStatus {
+		status := runStatus{Number: number, Start: time.Now()}
+		before := workFolders()
+		cmd := exec.Command(executable, args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		setProcessGroup(cmd)
+		err := cmd.Start()
+		if err == nil {
+			err = waitChild(ctx, cmd)
+		}
+		status.WorkFolder = newWorkFolder(before)
+		status.complete(err)
+		return status
+	}
+}
+
+// waitChild is a function that waits for the end of a started child. When the context is canceled
+// the child gets SIGTERM and is killed only if it is still running after the grace period.
+func waitChild(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	terminateChild(cmd)
+	timer := time.NewTimer(childGracePeriod)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		killChild(cmd)
+		return <-done
+	}
+}
+
+// runDaemon is a function that parses the daemon options, runs the daemon until a SIGTERM or
+// SIGINT is received and returns the exit code of the program.
+func runDaemon(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", daemonUsage) }
+	every := fs.Duration("every", 0, "")
+	cronExpr := fs.String("cron", "", "")
+	addr := fs.String("health-addr", ":8081", "")
+	timeout := fs.Duration("shutdown-timeout", 5*time.Minute, "")
+	runNow := fs.Bool("run-now", false, "")
+	if err := fs.Parse(args); err != nil {
+		return exitCodeConfig
+	}
+
+	var schedule Schedule
+	var spec string
+	switch {
+	case (*every > 0) == (*cronExpr != ""):
+		fmt.Fprint(os.Stderr, "\nExactly one of the -every or -cron options is required.\n")
+		fs.Usage()
+		return exitCodeConfig
+	case *every > 0:
+		schedule, spec = intervalSchedule(*every), "every "+every.String()
+	default:
+		c, err := ParseCron(*cronExpr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\n%v.\n", err)
+			fs.Usage()
+			return exitCodeConfig
+		}
+		schedule, spec = c, "cron "+*cronExpr
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nFailed to find the program path - Errmsg: %v\n", err)
+		return exitCodeError
+	}
+
+	logger := log.New(os.Stdout, "[ DAEMON ] ", log.LstdFlags)
+	d := newDaemon(schedule, spec, childRun(executable, fs.Args()), logger)
+
+	if *addr != "" {
+		listener, err := net.Listen("tcp", *addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nFailed to listen on %s - Errmsg: %v\n", *addr, err)
+			return exitCodeError
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/health", d)
+		mux.Handle("/status", d)
+		server := &http.Server{Handler: mux}
+		go server.Serve(listener)
+		defer server.Close()
+		logger.Printf("health and status served on http://%s/health and /status.\n", listener.Addr())
+	}
+
+	stop := make(chan struct{})
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	go func() {
+		sig := <-sigch
+		logger.Printf("received %v signal - stopping.\n", sig)
+		close(stop)
+	}()
+
+	logger.Printf("daemon started with schedule %q.\n", spec)
+	if *runNow {
+		d.Trigger()
+	}
+	d.Loop(stop)
+	if !d.Shutdown(*timeout) {
+		return exitCodeError
+	}
+	logger.Println("daemon stopped.")
+	return exitCodeSuccess
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDaemonNoOverlap(t *testing.T) {
+	var active, overlaps, runs int32
+	run := func(ctx context.Context, number int) runStatus {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		atomic.AddInt32(&runs, 1)
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return runStatus{Number: number, ExitStatus: exitSuccess}
+	}
+	d := newDaemon(intervalSchedule(10*time.Millisecond), "every 10ms", run, log.New(ioutil.Discard, "", 0))
+
+	stop := make(chan struct{})
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		close(stop)
+	}()
+	d.Loop(stop)
+	if !d.Shutdown(time.Second) {
+		t.Fatal("the current run was canceled")
+	}
+
+	s := d.Status()
+	if overlaps != 0 {
+		t.Errorf("got %d overlapping runs", overlaps)
+	}
+	if runs == 0 || s.Skipped == 0 || s.Runs != int(runs) {
+		t.Errorf("got %d runs and status %+v, wanted some runs and skipped ticks", runs, s)
+	}
+	if s.LastRun == nil || s.LastRun.Number != s.Runs || s.Status != "stopping" || s.Running {
+		t.Errorf("unexpected status after shutdown %+v", s)
+	}
+}
+
+func TestDaemonShutdownTimeout(t *testing.T) {
+	run := func(ctx context.Context, number int) runStatus {
+		<-ctx.Done()
+		return runStatus{Number: number, ExitCode: exitCodeError, ExitStatus: exitError, Error: "signal: killed"}
+	}
+	d := newDaemon(intervalSchedule(time.Hour), "every 1h", run, log.New(ioutil.Discard, "", 0))
+	if !d.Trigger() || d.Trigger() {
+		t.Fatal("expected only the first trigger to start a run")
+	}
+	if d.Shutdown(20 * time.Millisecond) {
+		t.Error("the blocked run was not canceled")
+	}
+	if d.Trigger() {
+		t.Error("a run started after the shutdown")
+	}
+	if s := d.Status(); s.LastRun == nil || s.LastRun.ExitStatus != exitError {
+		t.Errorf("unexpected last run %+v", s.LastRun)
+	}
+}
+
+func TestDaemonHTTP(t *testing.T) {
+	d := newDaemon(intervalSchedule(time.Hour), "every 1h", func(ctx context.Context, number int) runStatus {
+		return runStatus{Number: number, ExitCode: exitCodePartial, ExitStatus: exitPartial}
+	}, log.New(ioutil.Discard, "", 0))
+	d.Trigger()
+	d.wg.Wait()
+
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var s daemonStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got status %d and body %s", rec.Code, rec.Body)
+	}
+	if s.Runs != 1 || s.LastRun == nil || s.LastRun.ExitCode != exitCodePartial {
+		t.Errorf("unexpected status %+v", s)
+	}
+
+	d.Shutdown(time.Second)
+	rec = httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got health status %d while stopping, wanted 503", rec.Code)
+	}
+}
+
+func TestExitStatusOfCode(t *testing.T) {
+	for _, code := range []int{exitCodeSuccess, exitCodeError, exitCodePartial, exitCodeFailure, exitCodeUnchanged, exitCodeOutOfSync} {
+		if exitCodeOf(exitStatusOfCode(code)) != code {
+			t.Errorf("exit code %d got status %q", code, exitStatusOfCode(code))
+		}
+	}
+}
+
+// TestHelperRun is not a real test: it is the child process started by the tests of the child runs.
+// It loads the parameters placed after "--" as a run would do and exits with the config error code
+// when the api options are missing or when the source is not the expected one.
+func TestHelperRun(t *testing.T) {
+	if os.Getenv("EPROCESSOR_TEST_HELPER") != "1" {
+		return
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Args = append([]string{"eprocessor"}, args...)
+	// the usage of a config error is not relevant to the tests.
+	if devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stdout, os.Stderr = devnull, devnull
+	}
+	loadParameters()
+	if sourceURL != os.Getenv("EPROCESSOR_TEST_SOURCE") {
+		os.Exit(exitCodeConfig)
+	}
+	os.Exit(exitCodeSuccess)
+}
+
+// helperRunArgs is a function that returns the arguments starting the test binary as a run through
+// TestHelperRun with the api configured by the env variables. It returns a function restoring the env.
+func helperRunArgs(source string) ([]string, func()) {
+	names := []string{"EPROCESSOR_TEST_HELPER", "EPROCESSOR_TEST_SOURCE", "EPROCESSOR_API_URL", "EPROCESSOR_API_KEY", "EPROCESSOR_SOURCE_URL"}
+	previous := make(map[string]string)
+	for _, name := range names {
+		previous[name] = os.Getenv(name)
+	}
+	os.Setenv("EPROCESSOR_TEST_HELPER", "1")
+	os.Setenv("EPROCESSOR_TEST_SOURCE", source)
+	os.Setenv("EPROCESSOR_API_URL", "http://127.0.0.1:8080/records")
+	os.Setenv("EPROCESSOR_API_KEY", "my-key")
+	os.Setenv("EPROCESSOR_SOURCE_URL", "http://127.0.0.1:8080/default.csv")
+	return []string{"-test.run=^TestHelperRun$", "--"}, func() {
+		for _, name := range names {
+			os.Setenv(name, previous[name])
+		}
+	}
+}
+
+func TestChildRunEnvParameters(t *testing.T) {
+	args, restore := helperRunArgs("http://127.0.0.1:8080/data.csv")
+	defer restore()
+
+	// options given to the run are completed by the env variables.
+	status := childRun(os.Args[0], append(args, "-source", "http://127.0.0.1:8080/data.csv"))(context.Background(), 1)
+	if status.ExitCode != exitCodeSuccess {
+		t.Errorf("got exit code %d (%s), wanted %d", status.ExitCode, status.Error, exitCodeSuccess)
+	}
+
+	// without any env variable the api options are missing.
+	os.Setenv("EPROCESSOR_API_URL", "")
+	status = childRun(os.Args[0], append(args, "-source", "http://127.0.0.1:8080/data.csv"))(context.Background(), 2)
+	if status.ExitCode != exitCodeConfig {
+		t.Errorf("got exit code %d, wanted %d", status.ExitCode, exitCodeConfig)
+	}
+}
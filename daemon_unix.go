@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// This file holds how the child runs started by the daemon, watch and serve subcommands are stopped
+// on unix systems. Each child gets its own process group so that a cancel reaches its own processes too.
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the child into its own process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateChild sends SIGTERM to the process group of the child so that it saves its summary.
+func terminateChild(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// killChild sends SIGKILL to the process group of the child.
+func killChild(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
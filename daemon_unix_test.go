@@ -0,0 +1,57 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWaitChild(t *testing.T) {
+	defer func(d time.Duration) { childGracePeriod = d }(childGracePeriod)
+	childGracePeriod = 500 * time.Millisecond
+
+	casesTable := []struct {
+		script string
+		signal syscall.Signal
+	}{
+		// the child and the sleep it started are stopped by SIGTERM.
+		{"sleep 30 & wait", syscall.SIGTERM},
+		// a child ignoring SIGTERM is killed after the grace period.
+		{"trap '' TERM; sleep 30 & wait; wait", syscall.SIGKILL},
+	}
+
+	for _, c := range casesTable {
+		cmd := exec.Command("sh", "-c", c.script)
+		setProcessGroup(cmd)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		start := time.Now()
+		err := waitChild(ctx, cmd)
+		cancel()
+		elapsed := time.Since(start)
+
+		status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+		if err == nil || !ok || !status.Signaled() || status.Signal() != c.signal {
+			t.Errorf("child %q ended with %v, wanted signal %v", c.script, err, c.signal)
+		}
+		if elapsed > 5*time.Second {
+			t.Errorf("child %q stopped after %s", c.script, elapsed)
+		}
+		// no process of the group is left once the orphans are reaped.
+		deadline := time.Now().Add(2 * time.Second)
+		for syscall.Kill(-cmd.Process.Pid, 0) == nil && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if err := syscall.Kill(-cmd.Process.Pid, 0); err == nil {
+			t.Errorf("processes of the group of %q are still running", c.script)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+}
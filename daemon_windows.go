@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package main
+
+// This file holds how the child runs started by the daemon, watch and serve subcommands are stopped
+// on windows where there is neither process group nor SIGTERM: the child is killed right away.
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup has nothing to set on windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateChild kills the child since it could not be asked to stop.
+func terminateChild(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// killChild kills the child.
+func killChild(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
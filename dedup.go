@@ -0,0 +1,225 @@
+package main
+
+// This file contains the configurable deduplication stage. Records are compared on a key built from
+// a subset of their fields (all fields by default). Values could be normalized before comparison so
+// that "Jerome AMON " and "jerome amon" are taken as the same. Among each group of duplicates, either
+// the first or the last record is kept and the whole group is written into the duplicates.csv report.
+// Kept records could then be sorted by some fields so that submission order is the same at each run.
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// name of the file inside the work folder where duplicate groups are saved.
+const duplicatesFilename = "duplicates.csv"
+
+// ordered names of the fields of a processed record. used to select fields from flags.
+var fieldNames = []string{"date", "name", "address", "address2", "city", "state", "zipcode", "telephone", "mobile", "amount", "processor", "importdate"}
+
+// DedupOptions holds the settings of the deduplication stage.
+type DedupOptions struct {
+	// indexes of the fields making the key. all fields when empty.
+	Keys []int
+	// if true then values are trimmed, case-folded and inner spaces collapsed before comparison.
+	Normalize bool
+	// if true then the last record of each group is kept instead of the first one.
+	KeepLast bool
+}
+
+// A duplicateGroup is a set of records sharing the same deduplication key.
+type duplicateGroup struct {
+	key     string
+	kept    []string
+	removed [][]string
+}
+
+// parseFields is a function that converts a comma separated list of field names into their indexes.
+func parseFields(list string) ([]int, error) {
+	var indexes []int
+	for _, name := range splitList(list) {
+		index := -1
+		for i, field := range fieldNames {
+			if strings.EqualFold(name, field) {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			return nil, fmt.Errorf("unknown field %q - expected one of %s", name, strings.Join(fieldNames, ","))
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// normalizeValue trims the value, collapses inner whitespaces into one space and folds the case.
+func normalizeValue(value string) string {
+	return strings.ToLower(strings.Join(strings.Fields(value), " "))
+}
+
+// dedupKey is a function that builds the comparison key of a record based on the options.
+func dedupKey(record []string, opts DedupOptions) string {
+	var values []string
+	if len(opts.Keys) == 0 {
+		values = append(values, record...)
+	} else {
+		for _, i := range opts.Keys {
+			values = append(values, record[i])
+		}
+	}
+	if opts.Normalize {
+		for i, v := range values {
+			values[i] = normalizeValue(v)
+		}
+	}
+	// unit separator character could not be found into csv values.
+	return strings.Join(values, "\x1f")
+}
+
+// Fingerprint is a function that returns the hexadecimal sha256 of the deduplication key of a record.
+// The import date is never part of it since it changes at each run for the same source record.
+func Fingerprint(record []string, opts DedupOptions) string {
+	var keys []int
+	for i := range fieldNames {
+		if fieldNames[i] != "importdate" && (len(opts.Keys) == 0 || containsInt(opts.Keys, i)) {
+			keys = append(keys, i)
+		}
+	}
+	opts.Keys = keys
+	sum := sha256.Sum256([]byte(dedupKey(record, opts)))
+	return hex.EncodeToString(sum[:])
+}
+
+// containsInt reports if the value is present into the list.
+func containsInt(list []int, value int) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// DeduplicateRecords is a function that removes records sharing the same key. It keeps the first
+// or the last record of each group while preserving the order of the kept records into the file.
+// The groups which had at least one record removed are returned for reporting.
+func DeduplicateRecords(records [][]string, opts DedupOptions) ([][]string, []duplicateGroup) {
+	// position of the kept record for each key and keys in order of first appearance.
+	keptIndex := make(map[string]int)
+	members := make(map[string][]int)
+	var keys []string
+
+	for i, record := range records {
+		key := dedupKey(record, opts)
+		if _, found := keptIndex[key]; !found {
+			keys = append(keys, key)
+			keptIndex[key] = i
+		} else if opts.KeepLast {
+			keptIndex[key] = i
+		}
+		members[key] = append(members[key], i)
+	}
+
+	keep := make([]bool, len(records))
+	var groups []duplicateGroup
+	for _, key := range keys {
+		keep[keptIndex[key]] = true
+		if len(members[key]) == 1 {
+			continue
+		}
+		group := duplicateGroup{key: key, kept: records[keptIndex[key]]}
+		for _, i := range members[key] {
+			if i != keptIndex[key] {
+				group.removed = append(group.removed, records[i])
+			}
+		}
+		groups = append(groups, group)
+	}
+
+	var kept [][]string
+	for i, record := range records {
+		if keep[i] {
+			kept = append(kept, record)
+		}
+	}
+	return kept, groups
+}
+
+// saveDuplicatesReport is a function that writes each duplicate group into the duplicates.csv file
+// of the work folder. Each line holds the group number, the action applied and the record fields.
+func saveDuplicatesReport(folder string, groups []duplicateGroup) error {
+	f, err := os.Create(folder + string(os.PathSeparator) + duplicatesFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write(append([]string{"Group", "Action"}, fieldNames...))
+	for n, group := range groups {
+		id := strconv.Itoa(n + 1)
+		w.Write(append([]string{id, "kept"}, group.kept[:len(fieldNames)]...))
+		for _, record := range group.removed {
+			w.Write(append([]string{id, "removed"}, record[:len(fieldNames)]...))
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// SortRecords is a function that sorts the records by the given fields in order. Date fields are compared
+// as dates and the amount field by value when they could be parsed, other fields as plain text. The sort
+// is stable so that records with equal fields keep their file order.
+func SortRecords(records [][]string, fields []int, layouts []string) {
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, f := range fields {
+			if c := compareField(f, records[i][f], records[j][f], layouts); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// compareField is a function that compares two values of a given field. It returns a negative
+// number when a is lower than b, a positive number when a is greater than b and zero otherwise.
+func compareField(field int, a, b string, layouts []string) int {
+	switch fieldNames[field] {
+	case "date", "importdate":
+		// the import date is always generated with the default layout.
+		if fieldNames[field] == "importdate" {
+			layouts = []string{defaultDateLayouts}
+		}
+		ta, errA := ParseDate(a, layouts)
+		tb, errB := ParseDate(b, layouts)
+		if errA == nil && errB == nil {
+			switch {
+			case ta.Before(tb):
+				return -1
+			case ta.After(tb):
+				return 1
+			}
+			return 0
+		}
+	case "amount":
+		ma, errA := ParseAmount(a, defaultCurrency)
+		mb, errB := ParseAmount(b, defaultCurrency)
+		if errA == nil && errB == nil && ma.Currency == mb.Currency {
+			switch {
+			case ma.Cents < mb.Cents:
+				return -1
+			case ma.Cents > mb.Cents:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeduplicateRecords(t *testing.T) {
+	input := [][]string{
+		{"01/04/2016", "Jerome AMON ", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$90", "Stripe", "08/04/2021"},
+		{"01/04/2016", "Abou AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$90", "Stripe", "08/04/2021"},
+		{"01/04/2016", "jerome  amon", "Krakow Street", "missing", "Krakow", "PL", "38002", "missing", "000-000-0000", "$90", "Stripe", "08/04/2021"},
+	}
+
+	keys, err := parseFields("date,Name,amount")
+	if err != nil || !reflect.DeepEqual(keys, []int{0, 1, 9}) {
+		t.Fatalf("got keys %v (err: %v), wanted [0 1 9]", keys, err)
+	}
+	if _, err := parseFields("date,memo"); err == nil {
+		t.Errorf("parsing of unknown field should have failed")
+	}
+
+	// exact comparison keeps all records since names differ by case and spaces.
+	kept, groups := DeduplicateRecords(input, DedupOptions{Keys: keys})
+	if len(kept) != 3 || len(groups) != 0 {
+		t.Errorf("got %d kept records and %d groups, wanted 3 and 0", len(kept), len(groups))
+	}
+
+	// normalized comparison keeps the first record at its original position.
+	kept, groups = DeduplicateRecords(input, DedupOptions{Keys: keys, Normalize: true})
+	if !reflect.DeepEqual(kept, input[:2]) || len(groups) != 1 || len(groups[0].removed) != 1 {
+		t.Errorf("keep first - got kept %v and groups %v", kept, groups)
+	}
+
+	// keep last retains the third record after the second one.
+	kept, _ = DeduplicateRecords(input, DedupOptions{Keys: keys, Normalize: true, KeepLast: true})
+	if !reflect.DeepEqual(kept, input[1:]) {
+		t.Errorf("keep last - got kept %v, wanted %v", kept, input[1:])
+	}
+}
+
+func TestSortRecords(t *testing.T) {
+	input := [][]string{
+		{"02/01/2016", "Abou AMON", "$9"},
+		{"01/15/2016", "Jerome AMON", "$10"},
+		{"01/15/2016", "Abou AMON", "$100"},
+		{"01/15/2016", "Abou AMON", "$20"},
+	}
+
+	// by date then name - ties on both keep the file order.
+	SortRecords(input, []int{0, 1}, []string{"01/02/2006"})
+	want := []string{"$100", "$20", "$10", "$9"}
+	for i, record := range input {
+		if record[2] != want[i] {
+			t.Fatalf("after sorting by date and name. got %v, wanted amounts in order %v", input, want)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+// This file contains the diff subcommand. The source file is regenerated daily so instead of sending all
+// records again, two versions are compared: both files (or the source files of two previous work folders)
+// are processed like a normal run then their records are paired by the fingerprint of the -identity fields.
+// Records are classified as added, removed or modified and saved into the diff.csv report. Optionally the
+// added and modified records are submitted and the removed ones are sent to a DELETE endpoint whose url
+// could hold record fields like http://host/records/{date}-{name}. Old records whose new version was rejected
+// by the validation are reported as invalid and never deleted.
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// name of the file inside the work folder where the differences are saved.
+const diffFilename = "diff.csv"
+
+// possible statuses of a compared record.
+const (
+	diffAdded    = "added"
+	diffRemoved  = "removed"
+	diffModified = "modified"
+	diffInvalid  = "invalid"
+)
+
+// if true then two local files are compared instead of downloading the source.
+var diffMode bool
+
+// paths of the old and the new files or work folders to compare.
+var diffOld, diffNew string
+
+// indexes of the fields identifying a record between two versions - the deduplication fields when empty.
+var identityKeys []int
+
+// if true then the added and modified records are submitted.
+var submitChanges bool
+
+// url template of the DELETE endpoint receiving the removed records - not sent when empty.
+var deleteURL string
+
+// if true then the removed records are deleted even when the new file has no records at all.
+var allowEmptyDelete bool
+
+// outcome of the comparison of the current run for the summary.
+var diffCounts *DiffCounts
+
+// DiffCounts holds the outcome of a comparison.
+type DiffCounts struct {
+	Old          int `json:"old"`
+	New          int `json:"new"`
+	Added        int `json:"added"`
+	Removed      int `json:"removed"`
+	Modified     int `json:"modified"`
+	Unchanged    int `json:"unchanged"`
+	Invalid      int `json:"invalid"`
+	Deleted      int `json:"deleted"`
+	DeleteFailed int `json:"delete_failed"`
+}
+
+// A diffEntry is a record which differs between the two versions.
+type diffEntry struct {
+	status      string
+	fingerprint string
+	differences string
+	// new record for the added, modified and invalid entries, old one for the removed entries.
+	record Record
+}
+
+// placeholderPattern matches the {field} placeholders of an url template.
+var placeholderPattern = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// checkRecordTemplate is a function that verifies that all placeholders of an url template are fields names.
+func checkRecordTemplate(tmpl string) error {
+	for _, m := range placeholderPattern.FindAllStringSubmatch(tmpl, -1) {
+		if _, err := parseFields(m[1]); err != nil || strings.Contains(m[1], ",") || m[1] == "" {
+			return fmt.Errorf("unknown placeholder {%s} - expected one of %s", m[1], strings.Join(fieldNames, ","))
+		}
+	}
+	return nil
+}
+
+// expandRecordTemplate is a function that replaces the {field} placeholders of an url template by the
+// values of the record, escaped as path segments before the query and as query values after it.
+func expandRecordTemplate(tmpl string, r Record) string {
+	values := r.fields()
+	path, query := tmpl, ""
+	if i := strings.Index(tmpl, "?"); i != -1 {
+		path, query = tmpl[:i], tmpl[i:]
+	}
+	expand := func(part string, escape func(string) string) string {
+		return placeholderPattern.ReplaceAllStringFunc(part, func(p string) string {
+			indexes, err := parseFields(p[1 : len(p)-1])
+			if err != nil || len(indexes) != 1 {
+				return p
+			}
+			return escape(values[indexes[0]])
+		})
+	}
+	return expand(path, url.PathEscape) + expand(query, url.QueryEscape)
+}
+
+// resolveDiffInput is a function that returns the csv file to compare. A work folder stands for the
+// source file it downloaded, found with the source url of its summary or as its only other csv file.
+func resolveDiffInput(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return path, nil
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(path, summaryFilename+".json")); err == nil {
+		var s RunSummary
+		if json.Unmarshal(data, &s) == nil && s.SourceURL != "" {
+			if u, err := url.Parse(s.SourceURL); err == nil {
+				file := filepath.Join(path, filepath.Base(u.Path))
+				if _, err := os.Stat(file); err == nil {
+					return file, nil
+				}
+			}
+		}
+	}
+
+	reports := map[string]bool{duplicatesFilename: true, rejectsFilename: true, qualityFilename: true, fuzzyFilename + ".csv": true, reconcileFilename: true, diffFilename: true}
+	files, _ := filepath.Glob(filepath.Join(path, "*.csv"))
+	var candidates []string
+	for _, file := range files {
+		if !reports[filepath.Base(file)] {
+			candidates = append(candidates, file)
+		}
+	}
+	if len(candidates) != 1 {
+		return "", fmt.Errorf("could not find the source file into the work folder %s", path)
+	}
+	return candidates[0], nil
+}
+
+// Diff is a function that compares the old and the new records paired by their fingerprint computed
+// with the options. Old records left without pair but paired with an invalid new record (rejected by
+// the validation) are not removed. It returns the counts and the differences: added and modified records
+// in new order, invalid records in their order then removed records in old order.
+func Diff(old, new, invalid []Record, opts DedupOptions) (DiffCounts, []diffEntry) {
+	counts := DiffCounts{Old: len(old), New: len(new)}
+	var entries []diffEntry
+	paired := make([]bool, len(old))
+	for j, i := range pairRecords(old, new, opts) {
+		r := new[j]
+		if i == -1 {
+			counts.Added++
+			entries = append(entries, diffEntry{status: diffAdded, fingerprint: Fingerprint(r.fields(), opts), record: r})
+			continue
+		}
+		paired[i] = true
+		if diffs := recordDifferences(old[i], r, opts.Normalize); len(diffs) > 0 {
+			counts.Modified++
+			entries = append(entries, diffEntry{status: diffModified, fingerprint: Fingerprint(r.fields(), opts), differences: strings.Join(diffs, "; "), record: r})
+			continue
+		}
+		counts.Unchanged++
+	}
+
+	// the rejected new version of an old record does not mean that the record was removed.
+	var left []int
+	for i := range old {
+		if !paired[i] {
+			left = append(left, i)
+		}
+	}
+	remaining := make([]Record, len(left))
+	for k, i := range left {
+		remaining[k] = old[i]
+	}
+	for j, k := range pairRecords(remaining, invalid, opts) {
+		if k == -1 {
+			continue
+		}
+		paired[left[k]] = true
+		r := invalid[j]
+		counts.Invalid++
+		entries = append(entries, diffEntry{status: diffInvalid, fingerprint: Fingerprint(r.fields(), opts), differences: strings.Join(recordDifferences(old[left[k]], r, opts.Normalize), "; "), record: r})
+	}
+
+	for i, r := range old {
+		if !paired[i] {
+			counts.Removed++
+			entries = append(entries, diffEntry{status: diffRemoved, fingerprint: Fingerprint(r.fields(), opts), record: r})
+		}
+	}
+	return counts, entries
+}
+
+// saveDiffReport is a function that writes the differences into the diff.csv file.
+func saveDiffReport(folder string, entries []diffEntry) error {
+	f, err := os.Create(folder + string(os.PathSeparator) + diffFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write(append([]string{"status", "fingerprint", "differences"}, fieldNames...))
+	for _, e := range entries {
+		w.Write(append([]string{e.status, e.fingerprint, e.differences}, e.record.fields()...))
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// deleteRecord is a function that sends a DELETE request for a removed record. The payment record is
+// sent as body when the url template does not identify the record. A record already gone (404) is
+// taken as deleted. It returns nil on success or a short reason of the failure.
+func deleteRecord(r Record) error {
+	cid := generateID()
+	fields := logFields{CID: cid, Fingerprint: Fingerprint(r.fields(), dedupOptions), Method: http.MethodDelete}
+	target := expandRecordTemplate(deleteURL, r)
+	var body []byte
+	if !placeholderPattern.MatchString(deleteURL) {
+		body, _ = json.Marshal(PaymentRecord{PaymentRecord: r})
+	}
+	request, err := http.NewRequest(http.MethodDelete, target, bytes.NewReader(body))
+	if err != nil {
+		logError.With(fields).Printf("failure to build delete request - [cid: %s] - Errmsg: %v", cid, err)
+		return errors.New("invalid request")
+	}
+	request.Header.Set("X-API-KEY", apiKEY)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{Timeout: timeout * time.Second}
+	start := time.Now()
+	response, err := client.Do(request)
+	fields.Latency = time.Since(start)
+	if err != nil {
+		metrics.ObserveLatency("error", fields.Latency)
+		logError.With(fields).Printf("failure to delete record - [cid: %s] - Errmsg: %v", cid, err)
+		return errors.New("api unreachable")
+	}
+	response.Body.Close()
+	fields.Status = response.StatusCode
+	metrics.ObserveLatency(strconv.Itoa(response.StatusCode), fields.Latency)
+	metrics.CountMethod(http.MethodDelete)
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent, http.StatusNotFound:
+		logInfos.With(fields).Printf("success to delete record [cid: %s] at %s with status %d", cid, target, response.StatusCode)
+		return nil
+	}
+	logError.With(fields).Printf("failure to delete record - [cid: %s] - Errmsg: api status %d", cid, response.StatusCode)
+	return fmt.Errorf("api status %d", response.StatusCode)
+}
+
+// deleteRecords is a function that sends the removed records to the DELETE endpoint with a pool of
+// workers. It returns the number of deleted records and failures.
+func deleteRecords(records []Record) (int, int) {
+	numOfWorkers := len(records)/maxworkers + 1
+	if numOfWorkers > maxworkers {
+		numOfWorkers = maxworkers
+	}
+	if numWorkers > 0 {
+		numOfWorkers = numWorkers
+	}
+	var deleted, failed int64
+	var wg sync.WaitGroup
+	jobs := make(chan Record)
+	for i := 0; i < numOfWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				atomic.AddInt64(&metrics.submitted, 1)
+				err := deleteRecord(r)
+				metrics.Done(err, time.Now())
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+				} else {
+					atomic.AddInt64(&deleted, 1)
+				}
+			}
+		}()
+	}
+	for _, r := range records {
+		jobs <- r
+	}
+	close(jobs)
+	wg.Wait()
+	return int(deleted), int(failed)
+}
+
+// loadDiffSide is a function that processes one of the compared files like a normal run. It returns the
+// processed records and the records rejected by the validation or the normalization. The run is aborted
+// when the file has no records unless the new file is allowed to be empty.
+func loadDiffSide(label, path, importDate string) ([]Record, []Record) {
+	file, err := resolveDiffInput(path)
+	if err != nil {
+		fmt.Printf("\n\t[+] loading the %s file ... [ FAILURE ]\n\n\t[-] please check log file for more detailed reason. // ", label)
+		logError.Fatalf("failed to find the %s file - Errmsg: %v", label, err)
+	}
+	fmt.Printf("\n\t[+] processing the %s file %s\n", label, file)
+	logInfos.Printf("processing of the %s file %s started.\n", label, file)
+	allRecords, _, ok := prepareRecords(file, importDate)
+	if !ok && !(label == "new" && allowEmptyDelete) {
+		fmt.Print(" [ FAILURE ]\n\n\t[-] please check log file for more detailed reason. // ")
+		logError.Fatalf("the %s file %s does not have any records to compare", label, file)
+	}
+	records := make([]Record, 0, len(allRecords))
+	for _, record := range allRecords {
+		records = append(records, newRecord(record))
+	}
+	rejected := make([]Record, 0, len(preparedRejects))
+	for _, record := range preparedRejects {
+		rejected = append(rejected, newRecord(record))
+	}
+	return records, rejected
+}
+
+// diffFiles is a function that compares the old and the new files, saves the differences, submits
+// the added and modified records and deletes the removed ones when enabled.
+func diffFiles(oldPath, newPath string) {
+	importDate := time.Now().UTC().Format("01/02/2006")
+	if abs, err := filepath.Abs(newPath); err == nil {
+		sourceURL = "file://" + filepath.ToSlash(abs)
+	}
+
+	old, _ := loadDiffSide("old", oldPath, importDate)
+	// the counts and the reports of the run describe the new file.
+	for _, counter := range []*int64{&metrics.read, &metrics.rejected, &metrics.deduplicated} {
+		atomic.StoreInt64(counter, 0)
+	}
+	new, invalid := loadDiffSide("new", newPath, importDate)
+
+	setStage("diff")
+	fmt.Print("\n\t[+] comparing the old and the new records ... ")
+	opts := dedupOptions
+	if len(identityKeys) > 0 {
+		opts.Keys = identityKeys
+	}
+	counts, entries := Diff(old, new, invalid, opts)
+	if err := saveDiffReport(workFolder, entries); err != nil {
+		fmt.Print("[ FAILURE ]\n\n\t[-] please check log file for more detailed reason. // ")
+		logError.Fatalf("failed to save the diff report - Errmsg: %v", err)
+	}
+	keys := describeFields(opts.Keys)
+	if keys == "" {
+		keys = "all"
+	}
+	logInfos.Printf("comparison on %s fields completed - added: %d / removed: %d / modified: %d / unchanged: %d / invalid: %d.\n", keys, counts.Added, counts.Removed, counts.Modified, counts.Unchanged, counts.Invalid)
+	fmt.Println("[ SUCCESS ]")
+	fmt.Printf("\n\t[+] Old: %d / New: %d / added: %d / removed: %d / modified: %d / unchanged: %d / invalid: %d\n", counts.Old, counts.New, counts.Added, counts.Removed, counts.Modified, counts.Unchanged, counts.Invalid)
+	atomic.AddInt64(&metrics.skipped, int64(counts.Unchanged))
+	diffCounts = &counts
+
+	var changed, removed []Record
+	for _, e := range entries {
+		switch e.status {
+		case diffRemoved:
+			removed = append(removed, e.record)
+		case diffAdded, diffModified:
+			changed = append(changed, e.record)
+		}
+	}
+
+	// an empty new file is more likely a broken export than the removal of all records.
+	if deleteURL != "" && len(removed) > 0 && len(new) == 0 && !allowEmptyDelete {
+		setStage("delete")
+		fmt.Print("\n\t[+] deleting the removed records ... [ FAILURE ]\n\n\t[-] please check log file for more detailed reason. // ")
+		logError.Fatalf("refusing to delete all the %d old records since the new file has no records - use -allow-empty-delete to force it", len(removed))
+	}
+
+	if deleteURL != "" && len(removed) > 0 {
+		setStage("delete")
+		fmt.Printf("\n\t[+] deleting the %d removed records ... ", len(removed))
+		logInfos.Printf("deletion of %d removed records started.\n", len(removed))
+		counts.Deleted, counts.DeleteFailed = deleteRecords(removed)
+		diffCounts = &counts
+		logInfos.Printf("deletion completed - deleted: %d / fails: %d.\n", counts.Deleted, counts.DeleteFailed)
+		fmt.Printf("[ DONE ] [ %d DELETED / %d FAILED ]\n", counts.Deleted, counts.DeleteFailed)
+	}
+
+	if submitChanges && len(changed) > 0 {
+		setStage("submission")
+		submitRecords(changed, counts.New)
+	}
+}
+
+// needsAPI is a function that tells if the run sends anything to the api - comparing two files alone does not.
+func needsAPI() bool {
+	return !diffMode || submitChanges || deleteURL != ""
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old := []Record{
+		newRecord([]string{"01/02/2024", "Alice", "", "", "Krakow", "", "", "", "", "10", "", ""}),
+		newRecord([]string{"01/02/2024", "Bob", "", "", "Lodz", "", "", "", "", "20", "", ""}),
+		newRecord([]string{"01/03/2024", "Carol", "", "", "Warsaw", "", "", "", "", "30", "", ""}),
+	}
+	old = append(old, newRecord([]string{"01/05/2024", "Erin", "", "", "Gdynia", "", "", "", "", "50", "", ""}))
+	new := []Record{
+		newRecord([]string{"01/02/2024", "Alice", "", "", "Krakow", "", "", "", "", "10", "", ""}),
+		newRecord([]string{"01/02/2024", "Bob", "", "", "Gdansk", "", "", "", "", "20", "", ""}),
+		newRecord([]string{"01/04/2024", "Dave", "", "", "Poznan", "", "", "", "", "40", "", ""}),
+	}
+	// the new version of Erin was rejected by the validation.
+	invalid := []Record{
+		newRecord([]string{"01/05/2024", "Erin", "", "", "Gdynia", "", "", "", "", "fifty", "", ""}),
+	}
+	keys, _ := parseFields("date,name")
+	counts, entries := Diff(old, new, invalid, DedupOptions{Keys: keys})
+
+	want := DiffCounts{Old: 4, New: 3, Added: 1, Removed: 1, Modified: 1, Unchanged: 1, Invalid: 1}
+	if counts != want {
+		t.Fatalf("got counts %+v, wanted %+v", counts, want)
+	}
+	statuses := []string{diffModified, diffAdded, diffInvalid, diffRemoved}
+	names := []string{"Bob", "Dave", "Erin", "Carol"}
+	if len(entries) != len(statuses) {
+		t.Fatalf("got %d entries, wanted %d", len(entries), len(statuses))
+	}
+	for i, e := range entries {
+		if e.status != statuses[i] || e.record.Name != names[i] {
+			t.Errorf("entry %d got %s %s, wanted %s %s", i, e.status, e.record.Name, statuses[i], names[i])
+		}
+	}
+	if entries[0].differences == "" || entries[2].differences == "" {
+		t.Errorf("got differences %q and %q, wanted the changed fields", entries[0].differences, entries[2].differences)
+	}
+}
+
+func TestExpandRecordTemplate(t *testing.T) {
+	r := newRecord([]string{"01/02/2024", "Jane Doe", "", "", "Krakow", "", "", "", "", "$1,000", "", ""})
+	casesTable := []struct {
+		tmpl string
+		want string
+	}{
+		{"http://host/records/{date}-{name}?amount={amount}", "http://host/records/01%2F02%2F2024-Jane%20Doe?amount=%241%2C000"},
+		// query values holding & = or + do not break the query.
+		{"http://host/records?name={name}&city={city}", "http://host/records?name=Jane+Doe&city=A%26B+%3D+C%2BD"},
+	}
+	r.City = "A&B = C+D"
+	for _, c := range casesTable {
+		if got := expandRecordTemplate(c.tmpl, r); got != c.want {
+			t.Errorf("expansion of %s got %q, wanted %q", c.tmpl, got, c.want)
+		}
+	}
+
+	if err := checkRecordTemplate("http://host/records/{date}-{name}"); err != nil {
+		t.Errorf("got error %v, wanted a valid template", err)
+	}
+	for _, tmpl := range []string{"http://host/{id}", "http://host/{}", "http://host/{date,name}"} {
+		if checkRecordTemplate(tmpl) == nil {
+			t.Errorf("got template %q accepted, wanted an error", tmpl)
+		}
+	}
+}
+
+func TestResolveDiffInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the only csv file which is not a report stands for the source.
+	for _, name := range []string{"data.csv", duplicatesFilename, rejectsFilename} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0644)
+	}
+	if got, err := resolveDiffInput(dir); err != nil || got != filepath.Join(dir, "data.csv") {
+		t.Errorf("got %q (%v), wanted data.csv", got, err)
+	}
+
+	// the summary tells which file was downloaded.
+	ioutil.WriteFile(filepath.Join(dir, "export.csv"), []byte("x"), 0644)
+	if _, err := resolveDiffInput(dir); err == nil {
+		t.Error("got a file picked among several candidates, wanted an error")
+	}
+	ioutil.WriteFile(filepath.Join(dir, summaryFilename+".json"), []byte(`{"source_url":"https://host/export.csv"}`), 0644)
+	if got, err := resolveDiffInput(dir); err != nil || got != filepath.Join(dir, "export.csv") {
+		t.Errorf("got %q (%v) with the summary, wanted export.csv", got, err)
+	}
+
+	if got, err := resolveDiffInput(filepath.Join(dir, "data.csv")); err != nil || got != filepath.Join(dir, "data.csv") {
+		t.Errorf("got %q (%v) for a file, wanted the file itself", got, err)
+	}
+}
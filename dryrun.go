@@ -0,0 +1,147 @@
+package main
+
+// This file contains the dry-run mode. The whole pipeline is executed but instead of posting each
+// payment record to the API, the request which would have been sent is written as one json line into
+// the dryrun.jsonl file of the work folder. The values of the API key, of the credentials headers and of
+// the secret url query keys (and of the names given with -capture-redact) are redacted.
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// name of the file inside the work folder where dry-run requests are saved.
+const dryRunFilename = "dryrun.jsonl"
+
+// value which replaces any secret header or query value.
+const redacted = "REDACTED"
+
+// names of the headers and url query keys whose values are always redacted - compared case-insensitively.
+var secretNames = []string{
+	"X-Api-Key", "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+	"api_key", "apikey", "key", "token", "access_token", "password",
+}
+
+// comma separated names of extra headers and url query keys to redact.
+var redactNames string
+
+// isSecret is a function that tells if the value of a header or of a query key must be redacted.
+func isSecret(name string) bool {
+	for _, secret := range append(secretNames, splitList(redactNames)...) {
+		if strings.EqualFold(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// A dryRunEntry is the request which would have been sent for a payment record.
+type dryRunEntry struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// A dryRunWriter writes the requests into the dry-run file. It is a Sink safe for concurrent use by workers.
+type dryRunWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// newDryRunWriter is a function that creates the dry-run file into the work folder.
+func newDryRunWriter(folder string) (*dryRunWriter, error) {
+	f, err := os.Create(folder + string(os.PathSeparator) + dryRunFilename)
+	if err != nil {
+		return nil, err
+	}
+	return &dryRunWriter{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write builds the request of the payload exactly as it would be posted and saves it as one line.
+func (d *dryRunWriter) Write(payload []byte) error {
+	return d.write(http.MethodPost, apiURL, payload)
+}
+
+// write builds the request of the payload with the given method and url and saves it as one line.
+func (d *dryRunWriter) write(method, target string, payload []byte) error {
+	request, err := newPaymentRequest(method, target, payload)
+	if err != nil {
+		return err
+	}
+	entry := dryRunEntry{
+		Method:  request.Method,
+		URL:     redactURL(request.URL),
+		Headers: redactHeaders(request.Header),
+		Body:    json.RawMessage(payload),
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.enc.Encode(entry)
+}
+
+// Name returns the name of the dry-run file.
+func (d *dryRunWriter) Name() string { return "dry-run:" + d.file.Name() }
+
+// Send saves the first request of the job payload - the update of its resource in upsert mode.
+func (d *dryRunWriter) Send(j job) error {
+	method, target := paymentTarget(j.record)
+	return d.write(method, target, j.payload)
+}
+
+// Close closes the dry-run file.
+func (d *dryRunWriter) Close() error {
+	return d.file.Close()
+}
+
+// redactHeaders is a function that flattens the headers and hides the values of the secret ones.
+func redactHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for name := range header {
+		if isSecret(name) {
+			headers[name] = redacted
+			continue
+		}
+		headers[name] = header.Get(name)
+	}
+	return headers
+}
+
+// redactURL is a function that returns the url with the password and the values of the secret query
+// keys or of the API key hidden. The url is kept as is when it holds no secret.
+func redactURL(u *url.URL) string {
+	clean := *u
+	if _, ok := u.User.Password(); ok {
+		clean.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	query := u.Query()
+	changed := false
+	for name, values := range query {
+		for i, value := range values {
+			if isSecret(name) || (apiKEY != "" && value == apiKEY) {
+				values[i], changed = redacted, true
+			}
+		}
+	}
+	if changed {
+		clean.RawQuery = query.Encode()
+	}
+	return clean.String()
+}
+
+// redactError is a function that returns the message of a failed call with the url of the request redacted.
+func redactError(err error) string {
+	if e, ok := err.(*url.Error); ok {
+		if u, perr := url.Parse(e.URL); perr == nil {
+			clean := *e
+			clean.URL = redactURL(u)
+			return clean.Error()
+		}
+	}
+	return err.Error()
+}
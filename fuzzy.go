@@ -0,0 +1,240 @@
+package main
+
+// This file contains the fuzzy duplicate analysis. Records matching exactly on some fields (Date and
+// Amount by default) are compared on other fields (Name and Address by default) with the edit distance
+// of their normalized values. Records close enough are grouped as likely duplicates and reported into
+// the fuzzy.csv and fuzzy.html review files. By default nothing is removed from the submission unless
+// a drop distance is explicitly set, in which case only the first record of each close group is kept.
+
+import (
+	"encoding/csv"
+	"html/template"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// name of the files inside the work folder where likely duplicates are saved.
+const fuzzyFilename = "fuzzy"
+
+// FuzzyOptions holds the settings of the fuzzy duplicate analysis.
+type FuzzyOptions struct {
+	// indexes of the fields which must match exactly.
+	Exact []int
+	// indexes of the fields compared with edit distance.
+	Similar []int
+	// maximum total edit distance for two records to be likely duplicates.
+	MaxDistance int
+	// if greater than zero then records within this distance of the first one of their group are dropped.
+	DropDistance int
+}
+
+// A fuzzyGroup is a set of likely duplicate records along with their position into the
+// records and their distance to the first one.
+type fuzzyGroup struct {
+	indexes   []int
+	records   [][]string
+	distances []int
+}
+
+// levenshtein is a function that computes the edit distance between two strings.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// minInt returns the lowest of two integers.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// fuzzyDistance is a function that sums the edit distances of the normalized similar fields.
+func fuzzyDistance(a, b []string, similar []int) int {
+	distance := 0
+	for _, i := range similar {
+		distance += levenshtein(normalizeValue(a[i]), normalizeValue(b[i]))
+	}
+	return distance
+}
+
+// FindFuzzyDuplicates is a function that groups the records which match exactly on the exact fields
+// and whose similar fields are within the maximum distance of another record of the group. Groups are
+// returned into the order of their first record and only when they hold at least two records.
+func FindFuzzyDuplicates(records [][]string, opts FuzzyOptions) []fuzzyGroup {
+	// bucket records by the values of the exact fields.
+	buckets := make(map[string][]int)
+	var order []string
+	for i, record := range records {
+		key := dedupKey(record, DedupOptions{Keys: opts.Exact, Normalize: true})
+		if _, ok := buckets[key]; !ok {
+			order = append(order, key)
+		}
+		buckets[key] = append(buckets[key], i)
+	}
+
+	var groups []fuzzyGroup
+	for _, key := range order {
+		members := buckets[key]
+		if len(members) < 2 {
+			continue
+		}
+		// union-find over the members of the bucket linked when close enough.
+		parent := make([]int, len(members))
+		for i := range parent {
+			parent[i] = i
+		}
+		find := func(i int) int {
+			for parent[i] != i {
+				parent[i] = parent[parent[i]]
+				i = parent[i]
+			}
+			return i
+		}
+		for i := 0; i < len(members); i++ {
+			for j := i + 1; j < len(members); j++ {
+				if fuzzyDistance(records[members[i]], records[members[j]], opts.Similar) <= opts.MaxDistance {
+					parent[find(j)] = find(i)
+				}
+			}
+		}
+
+		// collect each set of linked members into the order of the file.
+		sets := make(map[int][]int)
+		var roots []int
+		for i := range members {
+			root := find(i)
+			if _, ok := sets[root]; !ok {
+				roots = append(roots, root)
+			}
+			sets[root] = append(sets[root], members[i])
+		}
+		for _, root := range roots {
+			if len(sets[root]) < 2 {
+				continue
+			}
+			var group fuzzyGroup
+			first := records[sets[root][0]]
+			for _, i := range sets[root] {
+				group.indexes = append(group.indexes, i)
+				group.records = append(group.records, records[i])
+				group.distances = append(group.distances, fuzzyDistance(first, records[i], opts.Similar))
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// DropFuzzyDuplicates is a function that removes from the records the members of each group which
+// are within the drop distance of the first record of their group. It returns the remaining records.
+func DropFuzzyDuplicates(records [][]string, groups []fuzzyGroup, dropDistance int) [][]string {
+	drop := make(map[int]bool)
+	for _, group := range groups {
+		for i, index := range group.indexes {
+			if i > 0 && group.distances[i] <= dropDistance {
+				drop[index] = true
+			}
+		}
+	}
+	var remaining [][]string
+	for i, record := range records {
+		if !drop[i] {
+			remaining = append(remaining, record)
+		}
+	}
+	return remaining
+}
+
+// fuzzyReportTemplate is the html page listing the likely duplicates groups for review.
+var fuzzyReportTemplate = template.Must(template.New("fuzzy").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>eprocessor - likely duplicates</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:4px 8px}tbody:nth-child(odd){background:#f4f4f4}</style>
+</head>
+<body>
+<h1>Likely duplicate records - {{len .Groups}} groups</h1>
+<table>
+<thead><tr><th>Group</th><th>Distance</th>{{range .Fields}}<th>{{.}}</th>{{end}}</tr></thead>
+{{range $g, $group := .Groups}}<tbody>
+{{range $i, $record := $group.Records}}<tr><td>{{inc $g}}</td><td>{{index $group.Distances $i}}</td>{{range $record}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</tbody>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// saveFuzzyReport is a function that writes the likely duplicates groups into the fuzzy.csv
+// and fuzzy.html files of the work folder with the distance of each record to the first one.
+func saveFuzzyReport(folder string, groups []fuzzyGroup) error {
+	base := folder + string(os.PathSeparator) + fuzzyFilename
+
+	f, err := os.Create(base + ".csv")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write(append([]string{"Group", "Distance"}, fieldNames...))
+	for n, group := range groups {
+		for i, record := range group.records {
+			w.Write(append([]string{strconv.Itoa(n + 1), strconv.Itoa(group.distances[i])}, record[:len(fieldNames)]...))
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	h, err := os.Create(base + ".html")
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	type htmlGroup struct {
+		Records   [][]string
+		Distances []int
+	}
+	data := struct {
+		Fields []string
+		Groups []htmlGroup
+	}{Fields: fieldNames}
+	for _, group := range groups {
+		var records [][]string
+		for _, record := range group.records {
+			records = append(records, record[:len(fieldNames)])
+		}
+		data.Groups = append(data.Groups, htmlGroup{Records: records, Distances: group.distances})
+	}
+	return fuzzyReportTemplate.Execute(h, data)
+}
+
+// describeFields is a function that returns the names of the fields at the given indexes.
+func describeFields(indexes []int) string {
+	var names []string
+	for _, i := range indexes {
+		names = append(names, fieldNames[i])
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLevenshtein(t *testing.T) {
+	casesTable := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"jerome amon", "jerome amon", 0},
+		{"jerome amon", "jerome amn", 1},
+		{"poland street", "polland streat", 2},
+		{"kraków", "krakow", 1},
+	}
+
+	for _, c := range casesTable {
+		if got := levenshtein(c.a, c.b); got != c.want {
+			t.Errorf("distance between %q and %q was incorrect, got: %d, wanted %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestFindFuzzyDuplicates(t *testing.T) {
+	input := [][]string{
+		{"01/04/2016", "Jerome AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$90", "Stripe", "08/04/2021"},
+		{"01/04/2016", "Abou AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$90", "Stripe", "08/04/2021"},
+		{"01/04/2016", "Jerome AMN", "Polland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$90", "Stripe", "08/04/2021"},
+		{"01/04/2016", "Jerome AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$10", "Stripe", "08/04/2021"},
+	}
+
+	opts := FuzzyOptions{Exact: []int{0, 9}, Similar: []int{1, 2}, MaxDistance: 2}
+	groups := FindFuzzyDuplicates(input, opts)
+	// only first and third records are close with same date and amount.
+	if len(groups) != 1 || len(groups[0].records) != 2 || groups[0].distances[1] != 2 {
+		t.Fatalf("got groups %v, wanted one group of first and third records at distance 2", groups)
+	}
+
+	if remaining := DropFuzzyDuplicates(input, groups, 1); len(remaining) != 4 {
+		t.Errorf("got %d remaining records, wanted 4 since distance is over the drop distance", len(remaining))
+	}
+	if remaining := DropFuzzyDuplicates(input, groups, 2); len(remaining) != 3 || remaining[1][1] != "Abou AMON" {
+		t.Errorf("got remaining records %v, wanted the third record dropped", remaining)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+// This file contains the cross-run deduplication ledger. It is an append-only file which stores the
+// fingerprint of each record successfully submitted along with the time of its acknowledgement. At
+// the next runs, records already present into the ledger are skipped so that a cumulative source file
+// does not lead to posting again the records of the previous days. Entries could expire after a given
+// duration and the ledger could be rebuilt from the statistics.log files of previous work folders.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Ledger holds the fingerprints of records acknowledged by the API into previous or current run.
+type Ledger struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]time.Time
+}
+
+// OpenLedger is a function that loads the ledger file at path or creates it. Entries older than
+// ttl are dropped and the file compacted. A zero ttl means that entries never expire.
+func OpenLedger(path string, ttl time.Duration) (*Ledger, error) {
+	l := &Ledger{path: path, entries: make(map[string]time.Time)}
+
+	expired := 0
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// each line is made of the fingerprint and the acknowledgement time.
+			parts := strings.Fields(scanner.Text())
+			if len(parts) != 2 {
+				continue
+			}
+			at, err := time.Parse(time.RFC3339, parts[1])
+			if err != nil {
+				continue
+			}
+			if ttl > 0 && time.Since(at) > ttl {
+				expired++
+				continue
+			}
+			l.entries[parts[0]] = at
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// rewrite the file without the expired entries.
+	if expired > 0 {
+		if err := l.compact(); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	l.file = f
+	return l, nil
+}
+
+// compact is a function that rewrites the ledger file with the current entries only.
+func (l *Ledger) compact() error {
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for fingerprint, at := range l.entries {
+		fmt.Fprintf(w, "%s %s\n", fingerprint, at.UTC().Format(time.RFC3339))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// Len returns the number of fingerprints into the ledger.
+func (l *Ledger) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// Seen reports if the fingerprint has already been acknowledged.
+func (l *Ledger) Seen(fingerprint string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.entries[fingerprint]
+	return ok
+}
+
+// Add records the fingerprint as acknowledged now and appends it to the ledger file.
+func (l *Ledger) Add(fingerprint string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[fingerprint]; ok {
+		return nil
+	}
+	now := time.Now().UTC()
+	l.entries[fingerprint] = now
+	_, err := fmt.Fprintf(l.file, "%s %s\n", fingerprint, now.Format(time.RFC3339))
+	return err
+}
+
+// Close closes the underlying ledger file.
+func (l *Ledger) Close() error {
+	return l.file.Close()
+}
+
+// isConvertedPayload is a function that tells if a payload was posted with the -typed or -normalize-amount
+// options. Its date and amount differ from the source fields so its fingerprint could not be rebuilt.
+func isConvertedPayload(record []byte) bool {
+	var p struct {
+		PaymentRecord map[string]json.RawMessage `json:"PaymentRecord"`
+	}
+	if json.Unmarshal(record, &p) != nil {
+		return false
+	}
+	for _, key := range []string{"currency", "amount_cents", "amount_original"} {
+		if _, ok := p.PaymentRecord[key]; ok {
+			return true
+		}
+	}
+	amount := p.PaymentRecord["amount"]
+	return len(amount) > 0 && amount[0] != '"'
+}
+
+// RebuildLedger is a function that replaces the ledger at path by the fingerprints of the records
+// found with SUCCESS status into the statistics.log files (text or json) matching the pattern. The modification
+// time of each statistics file is used as acknowledgement time. Typed and normalized payloads could not be
+// mapped back to the source fields and are skipped. It returns the number of entries and of skipped payloads.
+func RebuildLedger(path, pattern string, opts DedupOptions) (int, int, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, 0, err
+	}
+	skipped := 0
+
+	l := &Ledger{path: path, entries: make(map[string]time.Time)}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, 0, err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return 0, 0, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			// text lines look like [ SUCCESS ] [cid: xxx] {"PaymentRecord":{...}} and json
+			// lines like {"level":"success",...,"record":{"PaymentRecord":{...}}}.
+			var record []byte
+			if strings.HasPrefix(line, "{") {
+				var entry logEntry
+				if json.Unmarshal([]byte(line), &entry) != nil || entry.Level != "success" {
+					continue
+				}
+				record = entry.Record
+			} else if i := strings.Index(line, "{"); strings.HasPrefix(line, "[ SUCCESS ]") && i != -1 {
+				record = []byte(line[i:])
+			} else {
+				continue
+			}
+			if isConvertedPayload(record) {
+				skipped++
+				continue
+			}
+			var p PaymentRecord
+			if err := json.Unmarshal(record, &p); err != nil {
+				continue
+			}
+			l.entries[Fingerprint(p.PaymentRecord.fields(), opts)] = info.ModTime().UTC()
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err := l.compact(); err != nil {
+		return 0, 0, err
+	}
+	return len(l.entries), skipped, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "eprocessor.ledger")
+
+	// an old entry which should expire and a recent one.
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	content := "aaaa " + old + "\nbbbb " + time.Now().UTC().Format(time.RFC3339) + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := OpenLedger(path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Seen("aaaa") || !l.Seen("bbbb") {
+		t.Errorf("expired entry should be dropped and recent one kept")
+	}
+	l.Add("cccc")
+	l.Close()
+
+	// entries added are persisted for the next run.
+	l, err = OpenLedger(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Len() != 2 || !l.Seen("cccc") {
+		t.Errorf("got %d entries, wanted bbbb and cccc", l.Len())
+	}
+}
+
+func TestRebuildLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats := `[ SUCCESS ] [cid: 5c1d] {"PaymentRecord":{"date":"01/04/2016","name":"Jerome AMON","address":"Poland Street","address2":"missing","city":"Warsaw","state":"PL","zipcode":"38002","telephone":"missing","mobile":"000-000-0000","amount":"$90","processor":"Stripe","importdate":"08/04/2021"}}
+[ FAILURE ] [cid: 5c1e] {"PaymentRecord":{"date":"01/04/2017","name":"Jerome AMON","address":"Poland Street","address2":"missing","city":"Warsaw","state":"PL","zipcode":"38002","telephone":"missing","mobile":"000-000-0000","amount":"$90","processor":"Stripe","importdate":"08/04/2021"}}
+[ SUCCESS ] [cid: 5c20] {"PaymentRecord":{"date":"2016-01-04","name":"Jerome AMON","address":"Poland Street","address2":"missing","city":"Warsaw","state":"PL","zipcode":"38002","telephone":"missing","mobile":"000-000-0000","amount":"90.00","currency":"USD","processor":"Stripe","importdate":"2021-08-04"}}
+[ SUCCESS ] [cid: 5c21] {"PaymentRecord":{"date":"01/04/2019","name":"Jerome AMON","address":"Poland Street","address2":"missing","city":"Warsaw","state":"PL","zipcode":"38002","telephone":"missing","mobile":"000-000-0000","amount":9000,"processor":"Stripe","importdate":"08/04/2021"}}
+{"timestamp":"2021-08-04T10:10:10Z","level":"success","run_id":"a1b2","stage":"submission","cid":"5c1f","http_status":201,"record":{"PaymentRecord":{"date":"01/04/2018","name":"Jerome AMON","address":"Poland Street","address2":"missing","city":"Warsaw","state":"PL","zipcode":"38002","telephone":"missing","mobile":"000-000-0000","amount":"$90","processor":"Stripe","importdate":"08/04/2021"}}}
+`
+	os.Mkdir(filepath.Join(dir, "log@20210804.101010"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "log@20210804.101010", "statistics.log"), []byte(stats), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "eprocessor.ledger")
+	n, skipped, err := RebuildLedger(path, filepath.Join(dir, "log@*", "statistics.log"), DedupOptions{})
+	if err != nil || n != 2 || skipped != 2 {
+		t.Fatalf("got %d entries and %d skipped (err: %v), wanted 2 entries and 2 skipped", n, skipped, err)
+	}
+
+	// same record imported another day has the same fingerprint.
+	record := []string{"01/04/2016", "Jerome AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$90", "Stripe", "10/18/2021"}
+	l, err := OpenLedger(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !l.Seen(Fingerprint(record, DedupOptions{})) {
+		t.Errorf("record acknowledged into previous run should be seen")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+// This file contains the loggers of the details.log and statistics.log files. By default entries are
+// written as text lines with a prefix like "[ SUCCESS ] [cid: ...] {json}". With the json log format,
+// each entry is written as one json object with consistent fields (timestamp, level, run id, cid, stage,
+// http method and status, latency, error and record fingerprint) so that log shippers could parse them reliably.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// supported formats of the log files.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// format of the log files - text or json.
+var logFormat = logFormatText
+
+// called with the message of a fatal entry before the program stops.
+var onFatal func(msg string)
+
+// identifier of the current run added to each json entry.
+var runID string
+
+// name of the pipeline stage currently executed.
+var stage struct {
+	sync.Mutex
+	name string
+}
+
+// setStage records the name of the pipeline stage being executed.
+func setStage(name string) {
+	stage.Lock()
+	stage.name = name
+	stage.Unlock()
+}
+
+// currentStage returns the name of the pipeline stage being executed.
+func currentStage() string {
+	stage.Lock()
+	defer stage.Unlock()
+	return stage.name
+}
+
+// idPattern matches the call id (cid) or the failure id (sid) mentioned into a message.
+var idPattern = regexp.MustCompile(`\[[cs]id ?: ?([0-9a-f]+)\]`)
+
+// logFields holds the structured fields of an entry known by the caller.
+type logFields struct {
+	CID         string
+	Status      int
+	Latency     time.Duration
+	Fingerprint string
+	// http method of the API call.
+	Method string
+	// payment record json of the statistics entries.
+	Record []byte
+}
+
+// a logEntry is a line of a log file into json format.
+type logEntry struct {
+	Timestamp   string          `json:"timestamp"`
+	Level       string          `json:"level"`
+	RunID       string          `json:"run_id"`
+	Stage       string          `json:"stage,omitempty"`
+	CID         string          `json:"cid,omitempty"`
+	Method      string          `json:"method,omitempty"`
+	Status      int             `json:"http_status,omitempty"`
+	LatencyMs   float64         `json:"latency_ms,omitempty"`
+	Fingerprint string          `json:"fingerprint,omitempty"`
+	Message     string          `json:"message,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Record      json.RawMessage `json:"record,omitempty"`
+}
+
+// A Logger writes the entries of a log file as text lines with a prefix like the standard
+// logger does or as json lines when the json log format is enabled.
+type Logger struct {
+	level  string
+	text   *log.Logger
+	out    io.Writer
+	mu     *sync.Mutex
+	fields logFields
+}
+
+// newLogger is a function that creates a logger of the given level. The prefix and the flags
+// are only used by the text format. Loggers sharing the same mutex could share the same output.
+func newLogger(out io.Writer, mu *sync.Mutex, level, prefix string, flag int) *Logger {
+	return &Logger{level: level, text: log.New(out, prefix, flag), out: out, mu: mu}
+}
+
+// With returns a copy of the logger which adds the given fields to its json entries.
+func (l *Logger) With(fields logFields) *Logger {
+	c := *l
+	c.fields = fields
+	return &c
+}
+
+// Printf writes an entry with the message formatted like fmt.Printf.
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.output(fmt.Sprintf(format, v...))
+}
+
+// Println writes an entry with the message formatted like fmt.Println.
+func (l *Logger) Println(v ...interface{}) {
+	l.output(fmt.Sprintln(v...))
+}
+
+// Print writes an entry with the message formatted like fmt.Print.
+func (l *Logger) Print(v ...interface{}) {
+	l.output(fmt.Sprint(v...))
+}
+
+// Fatalf writes an entry like Printf then stops the program.
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.output(msg)
+	l.exit(msg)
+}
+
+// Fatal writes an entry like Print then stops the program.
+func (l *Logger) Fatal(v ...interface{}) {
+	msg := fmt.Sprint(v...)
+	l.output(msg)
+	l.exit(msg)
+}
+
+// exit stops the program after calling the fatal hook if any.
+func (l *Logger) exit(msg string) {
+	if onFatal != nil {
+		onFatal(msg)
+	}
+	os.Exit(exitCodeError)
+}
+
+// output writes the message into the configured format. The json entry takes the cid and the
+// error from the message when they are not provided as fields and statistics entries hold
+// the payment record instead of the message.
+func (l *Logger) output(msg string) {
+	if logFormat != logFormatJSON {
+		// caller of Printf and others is 3 levels above the text logger.
+		l.text.Output(3, msg)
+		return
+	}
+
+	msg = strings.TrimSpace(msg)
+	f := l.fields
+	entry := logEntry{
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Level:       l.level,
+		RunID:       runID,
+		Stage:       currentStage(),
+		CID:         f.CID,
+		Method:      f.Method,
+		Status:      f.Status,
+		Fingerprint: f.Fingerprint,
+	}
+	if f.Latency > 0 {
+		entry.LatencyMs = float64(f.Latency) / float64(time.Millisecond)
+	}
+	if entry.CID == "" {
+		if m := idPattern.FindStringSubmatch(msg); m != nil {
+			entry.CID = m[1]
+		}
+	}
+	if i := strings.Index(msg, "Errmsg: "); i != -1 {
+		entry.Error = msg[i+len("Errmsg: "):]
+		msg = strings.TrimRight(msg[:i], " -")
+	}
+	if len(f.Record) > 0 && json.Valid(f.Record) {
+		entry.Record = json.RawMessage(f.Record)
+	} else {
+		entry.Message = msg
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(data, '\n'))
+}
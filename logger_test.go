@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoggerFormats(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	stats := newLogger(&buf, &mu, "failure", "[ FAILURE ] ", 0)
+	details := newLogger(&buf, &mu, "error", "[ ERROR ] ", 0)
+	record := []byte(`{"PaymentRecord":{"date":"01/04/2016"}}`)
+	fields := logFields{CID: "5c1d", Status: 500, Latency: 1500 * time.Microsecond, Fingerprint: "abcd", Record: record}
+
+	// text remains the default format.
+	stats.With(fields).Printf("[cid: %s] %s", "5c1d", record)
+	if got := buf.String(); got != "[ FAILURE ] [cid: 5c1d] "+string(record)+"\n" {
+		t.Errorf("got text entry %q", got)
+	}
+
+	logFormat, runID = logFormatJSON, "a1b2"
+	defer func() { logFormat, runID = logFormatText, "" }()
+	setStage("submission")
+	defer setStage("")
+
+	buf.Reset()
+	stats.With(fields).Printf("[cid: %s] %s", "5c1d", record)
+	details.Printf("failure to submit record - [sid: 9f8e] - Errmsg: %v", "timeout")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d json entries, wanted 2", len(lines))
+	}
+	var entry logEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Level != "failure" || entry.RunID != "a1b2" || entry.Stage != "submission" || entry.CID != "5c1d" || entry.Status != 500 ||
+		entry.LatencyMs != 1.5 || entry.Fingerprint != "abcd" || entry.Message != "" || string(entry.Record) != string(record) {
+		t.Errorf("got statistics entry %+v", entry)
+	}
+	entry = logEntry{}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Level != "error" || entry.CID != "9f8e" || entry.Message != "failure to submit record - [sid: 9f8e]" || entry.Error != "timeout" {
+		t.Errorf("got details entry %+v", entry)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry.Timestamp); err != nil {
+		t.Errorf("got timestamp %q", entry.Timestamp)
+	}
+}
+
+// captureLoggers replaces the loggers of the run by loggers writing into buffers until restore is called.
+func captureLoggers() (details, stats *bytes.Buffer, restore func()) {
+	infos, errs, success, failure := logInfos, logError, logSuccessRecords, logFailureRecords
+	details, stats = new(bytes.Buffer), new(bytes.Buffer)
+	var detailsMu, statsMu sync.Mutex
+	logInfos = newLogger(details, &detailsMu, "info", "[ INFOS ] ", 0)
+	logError = newLogger(details, &detailsMu, "error", "[ ERROR ] ", 0)
+	logSuccessRecords = newLogger(stats, &statsMu, "success", "[ SUCCESS ] ", 0)
+	logFailureRecords = newLogger(stats, &statsMu, "failure", "[ FAILURE ] ", 0)
+	return details, stats, func() {
+		logInfos, logError, logSuccessRecords, logFailureRecords = infos, errs, success, failure
+	}
+}
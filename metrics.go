@@ -0,0 +1,239 @@
+package main
+
+// This file contains the metrics of a run exposed into the Prometheus text format when the -metrics-addr
+// option is set so that dashboards could follow long submissions. Counters track the records at each
+// stage of the pipeline, a histogram tracks the latency of the API calls by status code and gauges show
+// the number of busy workers and the number of records processed per second over the last seconds.
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds in seconds of the latency histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// maximum number of API call durations kept to compute the latency percentiles of the summary.
+const latencyReservoirSize = 10000
+
+// number of seconds over which the current rate is computed.
+const rateWindowSeconds = 10
+
+// a histogram counts observations into cumulative buckets.
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// observe adds a value to the histogram.
+func (h *histogram) observe(v float64) {
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// A Metrics holds the counters and gauges of a run. Counters are updated atomically.
+type Metrics struct {
+	read         int64
+	rejected     int64
+	deduplicated int64
+	skipped      int64
+	submitted    int64
+	succeeded    int64
+	failed       int64
+	retried      int64
+	inflight     int64
+
+	mu      sync.Mutex
+	latency map[string]*histogram
+	// uniform sample of the API calls durations (reservoir sampling) with the number of calls and the
+	// slowest one, and number of failures by reason for the summary.
+	durations []time.Duration
+	observed  int64
+	slowest   time.Duration
+	failures  map[string]int64
+	// number of records handled by each http method of the API.
+	methods map[string]int64
+	// number of processed records during each of the last seconds.
+	slots   [rateWindowSeconds]int64
+	seconds [rateWindowSeconds]int64
+}
+
+// metrics of the current run. always updated but only served when -metrics-addr is set.
+var metrics = newMetrics()
+
+// this stores the listening address of the metrics endpoint.
+var metricsAddr string
+
+// newMetrics is a function that creates empty metrics.
+func newMetrics() *Metrics {
+	return &Metrics{latency: make(map[string]*histogram), failures: make(map[string]int64), methods: make(map[string]int64)}
+}
+
+// ObserveLatency records the duration of an API call by its status code. Calls which did not get
+// any response use the "error" code.
+func (m *Metrics) ObserveLatency(code string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.latency[code]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		m.latency[code] = h
+	}
+	h.observe(d.Seconds())
+	m.sample(d)
+	if c := currentConcurrency(); c != nil {
+		c.Observe(code, d)
+	}
+}
+
+// sample keeps the duration into the bounded reservoir so that each call has the same chance to be
+// part of it whatever the length of the run. The caller holds the lock.
+func (m *Metrics) sample(d time.Duration) {
+	m.observed++
+	if d > m.slowest {
+		m.slowest = d
+	}
+	if len(m.durations) < latencyReservoirSize {
+		m.durations = append(m.durations, d)
+		return
+	}
+	if i := rand.Int63n(m.observed); i < latencyReservoirSize {
+		m.durations[i] = d
+	}
+}
+
+// CountMethod records the http method which handled a record.
+func (m *Metrics) CountMethod(method string) {
+	m.mu.Lock()
+	m.methods[method]++
+	m.mu.Unlock()
+}
+
+// Done records the outcome of a submitted record and counts it for the current rate. The
+// message of the error is used as reason of the failure.
+func (m *Metrics) Done(err error, now time.Time) {
+	if err == nil {
+		atomic.AddInt64(&m.succeeded, 1)
+	} else {
+		atomic.AddInt64(&m.failed, 1)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.failures[err.Error()]++
+	}
+	s := now.Unix()
+	i := s % rateWindowSeconds
+	if m.seconds[i] != s {
+		m.seconds[i], m.slots[i] = s, 0
+	}
+	m.slots[i]++
+}
+
+// Rate returns the average number of records processed per second over the last complete seconds.
+func (m *Metrics) Rate(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	s := now.Unix()
+	for i := range m.slots {
+		if age := s - m.seconds[i]; age > 0 && age <= rateWindowSeconds {
+			total += m.slots[i]
+		}
+	}
+	return float64(total) / rateWindowSeconds
+}
+
+// Write writes all metrics into the Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer) {
+	counters := []struct {
+		name, help string
+		value      *int64
+	}{
+		{"eprocessor_records_read_total", "Records read from the source file.", &m.read},
+		{"eprocessor_records_rejected_total", "Records rejected by the validation or normalization stages.", &m.rejected},
+		{"eprocessor_records_deduplicated_total", "Duplicate records removed before submission.", &m.deduplicated},
+		{"eprocessor_records_skipped_total", "Records skipped since acknowledged into previous runs.", &m.skipped},
+		{"eprocessor_records_submitted_total", "Records handed to the output sinks.", &m.submitted},
+		{"eprocessor_records_succeeded_total", "Records accepted by the output sinks.", &m.succeeded},
+		{"eprocessor_records_failed_total", "Records refused by or failed to reach the output sinks.", &m.failed},
+		{"eprocessor_records_retried_total", "Records submitted again after a failure.", &m.retried},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, atomic.LoadInt64(c.value))
+	}
+
+	fmt.Fprintf(w, "# HELP eprocessor_inflight_workers Workers currently sending a record.\n# TYPE eprocessor_inflight_workers gauge\neprocessor_inflight_workers %d\n", atomic.LoadInt64(&m.inflight))
+	fmt.Fprintf(w, "# HELP eprocessor_records_per_second Records processed per second over the last %d seconds.\n# TYPE eprocessor_records_per_second gauge\neprocessor_records_per_second %s\n", rateWindowSeconds, formatFloat(m.Rate(time.Now())))
+	if c := currentConcurrency(); c != nil {
+		fmt.Fprintf(w, "# HELP eprocessor_concurrency_limit Workers allowed to send at the same time by the adaptive concurrency.\n# TYPE eprocessor_concurrency_limit gauge\neprocessor_concurrency_limit %d\n", c.Limit())
+	}
+	if breaker != nil {
+		open := 0
+		if breaker.State() != breakerClosed {
+			open = 1
+		}
+		fmt.Fprintf(w, "# HELP eprocessor_circuit_breaker_open Whether the circuit breaker pauses the submission.\n# TYPE eprocessor_circuit_breaker_open gauge\neprocessor_circuit_breaker_open %d\n", open)
+	}
+	fmt.Fprintf(w, "# HELP eprocessor_run_info Identifier of the current run.\n# TYPE eprocessor_run_info gauge\neprocessor_run_info{run_id=%q} 1\n", runID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var codes []string
+	for code := range m.latency {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	fmt.Fprint(w, "# HELP eprocessor_request_duration_seconds Latency of the API calls by status code.\n# TYPE eprocessor_request_duration_seconds histogram\n")
+	for _, code := range codes {
+		h := m.latency[code]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "eprocessor_request_duration_seconds_bucket{code=%q,le=%q} %d\n", code, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(w, "eprocessor_request_duration_seconds_bucket{code=%q,le=\"+Inf\"} %d\n", code, h.count)
+		fmt.Fprintf(w, "eprocessor_request_duration_seconds_sum{code=%q} %s\n", code, formatFloat(h.sum))
+		fmt.Fprintf(w, "eprocessor_request_duration_seconds_count{code=%q} %d\n", code, h.count)
+	}
+}
+
+// formatFloat returns the shortest representation of a float value.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ServeHTTP serves the metrics to the Prometheus scraper.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Write(w)
+}
+
+// startMetricsServer is a function that listens on the given address and serves the
+// metrics on the /metrics route into background until the program exits.
+func startMetricsServer(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logError.Printf("metrics endpoint stopped - Errmsg: %v", err)
+		}
+	}()
+	return nil
+}
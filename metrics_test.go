@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	m.read = 800
+	m.deduplicated = 527
+	now := time.Unix(1000, 0)
+	for i := 0; i < 20; i++ {
+		m.Done(testFailure(i), now.Add(-time.Duration(i%5)*time.Second))
+	}
+	m.ObserveLatency("201", 3*time.Millisecond)
+	m.ObserveLatency("201", 300*time.Millisecond)
+	m.ObserveLatency("error", 20*time.Second)
+
+	// the current second is not complete yet and is not part of the rate.
+	if got := m.Rate(now); got != 1.6 {
+		t.Errorf("got rate %v, wanted 1.6", got)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	for _, line := range []string{
+		"eprocessor_records_read_total 800",
+		"eprocessor_records_deduplicated_total 527",
+		"eprocessor_records_succeeded_total 15",
+		"eprocessor_records_failed_total 5",
+		"eprocessor_inflight_workers 0",
+		"# TYPE eprocessor_request_duration_seconds histogram",
+		`eprocessor_request_duration_seconds_bucket{code="201",le="0.005"} 1`,
+		`eprocessor_request_duration_seconds_bucket{code="201",le="0.5"} 2`,
+		`eprocessor_request_duration_seconds_bucket{code="error",le="10"} 0`,
+		`eprocessor_request_duration_seconds_bucket{code="error",le="+Inf"} 1`,
+		`eprocessor_request_duration_seconds_sum{code="201"} 0.303`,
+		`eprocessor_request_duration_seconds_count{code="201"} 2`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("metrics do not contain %q", line)
+		}
+	}
+}
+
+// testFailure returns a failure for one record out of four.
+func testFailure(i int) error {
+	if i%4 == 0 {
+		return errors.New("api status 500")
+	}
+	return nil
+}
+
+func TestLatencyReservoir(t *testing.T) {
+	m := newMetrics()
+	calls := 3 * latencyReservoirSize
+	for i := 1; i <= calls; i++ {
+		m.ObserveLatency("201", time.Duration(i)*time.Microsecond)
+	}
+	if len(m.durations) != latencyReservoirSize {
+		t.Fatalf("got %d kept durations, wanted %d", len(m.durations), latencyReservoirSize)
+	}
+
+	s := m.Summary(time.Now(), "")
+	if s.Latency.Count != calls || s.Latency.Max != float64(calls)/1000 {
+		t.Errorf("got count %d and max %v, wanted %d and %v", s.Latency.Count, s.Latency.Max, calls, float64(calls)/1000)
+	}
+	// the median of the sample stays close to the median of all calls.
+	if median := float64(calls) / 2000; s.Latency.P50 < median*0.9 || s.Latency.P50 > median*1.1 {
+		t.Errorf("got p50 %v, wanted about %v", s.Latency.P50, median)
+	}
+}
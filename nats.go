@@ -0,0 +1,286 @@
+package main
+
+// This file contains the message queue sink. Each payment record json is published as an event to a
+// NATS JetStream subject so that downstream teams could consume the cleaned records. The fingerprint
+// of the record is set as message id (Nats-Msg-Id header) which is the key used by the stream to drop
+// duplicates. A record is counted as succeeded only once the stream acknowledged its storage. The
+// client side of the protocol is implemented here with the standard library only.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// default port of a nats server.
+const natsDefaultPort = "4222"
+
+// natsPubAck is the acknowledgement sent by the stream for each published message.
+type natsPubAck struct {
+	Stream    string `json:"stream"`
+	Seq       uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate"`
+	Error     *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// A natsSink publishes records to a subject and waits for their acknowledgement.
+type natsSink struct {
+	name    string
+	subject string
+	timeout time.Duration
+	conn    net.Conn
+	inbox   string
+	seq     uint64
+
+	// protects writes to the connection.
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	// acknowledgements awaited by reply subject.
+	mu      sync.Mutex
+	pending map[string]chan error
+	err     error
+}
+
+// newNATSSink is a function that connects to the server at the url nats://[user:pass@]host[:port]/subject
+// and subscribes to the inbox where acknowledgements are received.
+func newNATSSink(rawurl string, timeout time.Duration) (*natsSink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	subject := strings.Trim(u.Path, "/")
+	if u.Host == "" || subject == "" {
+		return nil, fmt.Errorf("invalid nats sink %q - expected nats://host:port/subject", rawurl)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), natsDefaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &natsSink{
+		name:    "nats:" + host + "/" + subject,
+		subject: subject,
+		timeout: timeout,
+		conn:    conn,
+		w:       bufio.NewWriter(conn),
+		pending: make(map[string]chan error),
+	}
+	r := bufio.NewReader(conn)
+	if err := s.handshake(r, u.User); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go s.readLoop(r)
+	return s, nil
+}
+
+// handshake reads the server information, sends the connection options and waits for
+// the server to confirm them before subscribing to the acknowledgements inbox.
+func (s *natsSink) handshake(r *bufio.Reader, user *url.Userinfo) error {
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+	defer s.conn.SetDeadline(time.Time{})
+
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected nats greeting %q", line)
+	}
+	var info struct {
+		Headers bool `json:"headers"`
+	}
+	if err := json.Unmarshal([]byte(line[5:]), &info); err != nil {
+		return err
+	}
+	if !info.Headers {
+		return errors.New("nats server does not support headers needed for message ids")
+	}
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "headers": true, "no_responders": true, "protocol": 1, "name": "eprocessor", "lang": "go"}
+	if user != nil {
+		if pass, ok := user.Password(); ok {
+			options["user"], options["pass"] = user.Username(), pass
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+	fmt.Fprintf(s.w, "CONNECT %s\r\nPING\r\n", connect)
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			return fmt.Errorf("nats server refused the connection: %s", line)
+		}
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	s.inbox = "_INBOX." + hex.EncodeToString(id)
+	fmt.Fprintf(s.w, "SUB %s.* 1\r\n", s.inbox)
+	return s.w.Flush()
+}
+
+// readLine returns the next protocol line without its ending.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readLoop reads the messages of the server and delivers the acknowledgements to their publisher.
+// When the connection fails, all awaited acknowledgements are failed with the same error.
+func (s *natsSink) readLoop(r *bufio.Reader) {
+	var err error
+	for err == nil {
+		var line string
+		if line, err = readLine(r); err != nil {
+			break
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			s.write("PONG\r\n")
+		case "-ERR":
+			err = fmt.Errorf("nats server error: %s", line)
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> [reply] <size> and HMSG <subject> <sid> [reply] <header size> <total size>
+			headerSize, total := 0, 0
+			if total, err = strconv.Atoi(args[len(args)-1]); err != nil {
+				break
+			}
+			if args[0] == "HMSG" {
+				if headerSize, err = strconv.Atoi(args[len(args)-2]); err != nil {
+					break
+				}
+			}
+			data := make([]byte, total+2)
+			if _, err = io.ReadFull(r, data); err != nil {
+				break
+			}
+			s.deliver(args[1], data[:headerSize], data[headerSize:total])
+		}
+	}
+
+	s.mu.Lock()
+	s.err = err
+	for reply, ch := range s.pending {
+		ch <- fmt.Errorf("connection lost before acknowledgement: %v", err)
+		delete(s.pending, reply)
+	}
+	s.mu.Unlock()
+}
+
+// deliver converts an acknowledgement into the result of the publisher waiting on that reply subject.
+func (s *natsSink) deliver(reply string, header, payload []byte) {
+	s.mu.Lock()
+	ch, ok := s.pending[reply]
+	delete(s.pending, reply)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// a status header without payload means that no stream listens to the subject.
+	if status := strings.Fields(strings.SplitN(string(header), "\r\n", 2)[0]); len(status) > 1 && len(payload) == 0 {
+		ch <- fmt.Errorf("no stream acknowledged the message (status %s)", strings.Join(status[1:], " "))
+		return
+	}
+	var ack natsPubAck
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		ch <- fmt.Errorf("invalid acknowledgement %q: %v", payload, err)
+		return
+	}
+	if ack.Error != nil {
+		ch <- fmt.Errorf("stream refused the message: %d %s", ack.Error.Code, ack.Error.Description)
+		return
+	}
+	ch <- nil
+}
+
+// write sends raw protocol data to the server.
+func (s *natsSink) write(data string) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.w.WriteString(data)
+	return s.w.Flush()
+}
+
+// Name returns the name of the sink with its server and subject.
+func (s *natsSink) Name() string { return s.name }
+
+// Send publishes the payload of the job with its fingerprint as message id and waits for the
+// acknowledgement of the stream until the timeout.
+func (s *natsSink) Send(j job) error {
+	reply := s.inbox + "." + strconv.FormatUint(atomic.AddUint64(&s.seq, 1), 10)
+	ch := make(chan error, 1)
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	s.pending[reply] = ch
+	s.mu.Unlock()
+
+	header := "NATS/1.0\r\nNats-Msg-Id: " + j.fingerprint + "\r\n\r\n"
+	msg := fmt.Sprintf("HPUB %s %s %d %d\r\n%s%s\r\n", s.subject, reply, len(header), len(header)+len(j.payload), header, j.payload)
+	if err := s.write(msg); err != nil {
+		s.forget(reply)
+		return err
+	}
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-ch:
+		return err
+	case <-timer.C:
+		s.forget(reply)
+		return fmt.Errorf("no acknowledgement within %v", s.timeout)
+	}
+}
+
+// forget stops waiting for the acknowledgement of a reply subject.
+func (s *natsSink) forget(reply string) {
+	s.mu.Lock()
+	delete(s.pending, reply)
+	s.mu.Unlock()
+}
+
+// Close closes the connection.
+func (s *natsSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATS is an in-process stand-in of a nats server with a stream listening to every subject.
+type fakeNATS struct {
+	listener net.Listener
+	mu       sync.Mutex
+	// published payloads by message id.
+	messages map[string]string
+	// acknowledgement mode - ok, error, status or none.
+	mode string
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNATS{listener: l, messages: make(map[string]string), mode: "ok"}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var wmu sync.Mutex
+	write := func(format string, args ...interface{}) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		fmt.Fprintf(conn, format, args...)
+	}
+	write("INFO {\"server_id\":\"fake\",\"headers\":true}\r\n")
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		switch args[0] {
+		case "PING":
+			write("PONG\r\n")
+		case "HPUB":
+			headerSize, _ := strconv.Atoi(args[3])
+			total, _ := strconv.Atoi(args[4])
+			data := make([]byte, total+2)
+			io.ReadFull(r, data)
+			id := strings.TrimSpace(strings.SplitN(string(data[:headerSize]), "Nats-Msg-Id:", 2)[1])
+
+			f.mu.Lock()
+			_, duplicate := f.messages[id]
+			f.messages[id] = string(data[headerSize:total])
+			seq, mode := len(f.messages), f.mode
+			f.mu.Unlock()
+
+			switch mode {
+			case "ok":
+				ack := fmt.Sprintf(`{"stream":"PAYMENTS","seq":%d,"duplicate":%t}`, seq, duplicate)
+				write("MSG %s 1 %d\r\n%s\r\n", args[2], len(ack), ack)
+			case "error":
+				ack := `{"error":{"code":503,"description":"insufficient resources"}}`
+				write("MSG %s 1 %d\r\n%s\r\n", args[2], len(ack), ack)
+			case "status":
+				header := "NATS/1.0 503\r\n\r\n"
+				write("HMSG %s 1 %d %d\r\n%s\r\n", args[2], len(header), len(header), header)
+			}
+		}
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	server := newFakeNATS(t)
+	defer server.listener.Close()
+
+	if _, err := newNATSSink("nats://"+server.listener.Addr().String(), time.Second); err == nil {
+		t.Errorf("url without subject should have failed")
+	}
+	s, err := newNATSSink("nats://"+server.listener.Addr().String()+"/payments.records", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// concurrent publications are all acknowledged and keyed by their fingerprint.
+	var wg sync.WaitGroup
+	dates := []string{"01/04/2016", "01/04/2017", "01/04/2018", "01/04/2016"}
+	for _, date := range dates {
+		wg.Add(1)
+		go func(date string) {
+			defer wg.Done()
+			if err := s.Send(testJob(date)); err != nil {
+				t.Errorf("got error %v", err)
+			}
+		}(date)
+	}
+	wg.Wait()
+	j := testJob("01/04/2017")
+	if len(server.messages) != 3 || server.messages[j.fingerprint] != string(j.payload) {
+		t.Errorf("got published messages %v", server.messages)
+	}
+
+	for mode, want := range map[string]string{"error": "insufficient resources", "status": "no stream", "none": "no acknowledgement"} {
+		server.mu.Lock()
+		server.mode = mode
+		server.mu.Unlock()
+		if err := s.Send(testJob("01/04/2019")); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("mode %s got error %v, wanted %q", mode, err, want)
+		}
+	}
+
+	// awaiting publishers are released when the connection is lost.
+	server.listener.Close()
+	s.conn.Close()
+	time.Sleep(10 * time.Millisecond)
+	if err := s.Send(testJob("01/04/2020")); err == nil {
+		t.Errorf("publication over a closed connection should have failed")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+// This file contains the PostgreSQL sink used for backfills. Records are not inserted one by one but
+// gathered into batches which are loaded with COPY inside a transaction. When upsert is enabled, each
+// batch is copied into a temporary table then merged into the target table on the record fingerprint
+// so that loading the same records again updates them instead of failing. Target table and columns
+// names are configurable. The driver is registered by building the program with the postgres tag.
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// name of the database/sql driver used by the postgres sink. it must support COPY FROM STDIN through
+// prepared statements like github.com/lib/pq does (see sink_postgres.go).
+var postgresDriver = "postgres"
+
+// name of the temporary table used to merge a batch when upsert is enabled.
+const pgStagingTable = "eprocessor_staging"
+
+// PostgresOptions holds the settings of the postgres sink.
+type PostgresOptions struct {
+	// name of the target table - could be qualified with its schema.
+	Table string
+	// column name of each field (and of the fingerprint) when different from the field name.
+	Columns map[string]string
+	// maximum number of records loaded into one transaction.
+	BatchSize int
+	// if true then existing rows with the same fingerprint are updated.
+	Upsert bool
+	// time to wait for other records before loading an incomplete batch.
+	Linger time.Duration
+}
+
+// parseColumnMapping is a function that converts a comma separated list of field=column items into
+// a map. Fields are the names of the record fields or fingerprint.
+func parseColumnMapping(list string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, item := range splitList(list) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid column mapping %q - expected field=column", item)
+		}
+		field := strings.ToLower(strings.TrimSpace(parts[0]))
+		if field != "fingerprint" {
+			if _, err := parseFields(field); err != nil {
+				return nil, err
+			}
+		}
+		mapping[field] = strings.TrimSpace(parts[1])
+	}
+	return mapping, nil
+}
+
+// quoteIdent is a function that quotes an identifier which could be qualified with its schema.
+func quoteIdent(name string) string {
+	var parts []string
+	for _, part := range strings.Split(name, ".") {
+		parts = append(parts, `"`+strings.Replace(part, `"`, `""`, -1)+`"`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// number of workers of the current submission - 0 outside of a submission.
+var submitWorkers int64
+
+// pgSenders is a function that returns the number of workers which could be sending at the same time
+// - the limit of the adaptive concurrency when enabled and 0 when unknown.
+func pgSenders() int {
+	if c := currentConcurrency(); c != nil {
+		return c.Limit()
+	}
+	return int(atomic.LoadInt64(&submitWorkers))
+}
+
+// a pgRow is a record waiting into a batch with the channel where its loading result is delivered.
+type pgRow struct {
+	values []interface{}
+	done   chan error
+}
+
+// A pgSink loads records into a postgres table by batches.
+type pgSink struct {
+	name    string
+	db      *sql.DB
+	opts    PostgresOptions
+	table   string
+	columns []string
+
+	mu      sync.Mutex
+	pending []pgRow
+	timer   *time.Timer
+}
+
+// newPostgresSink is a function that connects to the database at dsn and creates the target
+// table if needed. The fingerprint column is the primary key used to merge records.
+func newPostgresSink(dsn string, opts PostgresOptions) (*pgSink, error) {
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	column := func(field string) string {
+		if c, ok := opts.Columns[field]; ok {
+			return quoteIdent(c)
+		}
+		return quoteIdent(field)
+	}
+	s := &pgSink{opts: opts, table: quoteIdent(opts.Table), columns: []string{column("fingerprint")}}
+	for _, field := range fieldNames {
+		s.columns = append(s.columns, column(field))
+	}
+
+	// never display the credentials of the connection.
+	s.name = "postgres:" + opts.Table
+	if u, err := url.Parse(dsn); err == nil && u.Host != "" {
+		s.name += "@" + u.Host + u.Path
+	}
+
+	db, err := sql.Open(postgresDriver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%v - the program must be built with the postgres tag to use this sink", err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s TEXT PRIMARY KEY, %s TEXT)", s.table, s.columns[0], strings.Join(s.columns[1:], " TEXT, "))); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.db = db
+	return s, nil
+}
+
+// Name returns the name of the sink with its table and database host.
+func (s *pgSink) Name() string { return s.name }
+
+// Send adds the record to the current batch and waits until the batch is committed. A full batch
+// is loaded right away by the caller as well as a batch which every worker is waiting for, since
+// no other record could come. Any other incomplete batch is loaded after the linger time.
+func (s *pgSink) Send(j job) error {
+	row := pgRow{values: []interface{}{j.fingerprint}, done: make(chan error, 1)}
+	for _, v := range j.record.fields() {
+		row.values = append(row.values, v)
+	}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, row)
+	if n := pgSenders(); len(s.pending) >= s.opts.BatchSize || (n > 0 && len(s.pending) >= n) {
+		batch := s.take()
+		s.mu.Unlock()
+		s.flush(batch)
+	} else {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		s.timer = time.AfterFunc(s.opts.Linger, s.flushPending)
+		s.mu.Unlock()
+	}
+	return <-row.done
+}
+
+// take returns the pending records and starts a new batch. It must be called with the lock held.
+func (s *pgSink) take() []pgRow {
+	batch := s.pending
+	s.pending = nil
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	return batch
+}
+
+// flushPending loads the pending records if any.
+func (s *pgSink) flushPending() {
+	s.mu.Lock()
+	batch := s.take()
+	s.mu.Unlock()
+	if len(batch) > 0 {
+		s.flush(batch)
+	}
+}
+
+// flush loads the batch and delivers the result to each of its records.
+func (s *pgSink) flush(batch []pgRow) {
+	err := s.load(batch)
+	for _, row := range batch {
+		row.done <- err
+	}
+}
+
+// load copies the batch into the table inside a single transaction. With upsert the batch
+// is copied into a temporary table dropped at commit then merged on the fingerprint column.
+func (s *pgSink) load(batch []pgRow) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	target := s.table
+	if s.opts.Upsert {
+		target = quoteIdent(pgStagingTable)
+		if _, err := tx.Exec(fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", target, s.table)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	columns := strings.Join(s.columns, ", ")
+	stmt, err := tx.Prepare(fmt.Sprintf("COPY %s (%s) FROM STDIN", target, columns))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, row := range batch {
+		if _, err := stmt.Exec(row.values...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	// an execution without arguments ends the copy of the rows.
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return err
+	}
+	stmt.Close()
+
+	if s.opts.Upsert {
+		var updates []string
+		for _, c := range s.columns[1:] {
+			updates = append(updates, c+" = EXCLUDED."+c)
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) SELECT DISTINCT ON (%s) %s FROM %s ON CONFLICT (%s) DO UPDATE SET %s",
+			s.table, columns, s.columns[0], columns, target, s.columns[0], strings.Join(updates, ", "))
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Close loads the remaining records and closes the database.
+func (s *pgSink) Close() error {
+	s.flushPending()
+	return s.db.Close()
+}
@@ -0,0 +1,321 @@
+package main
+
+// This file contains the data quality profiling of an input file. Before trusting a new partner file, its
+// shape is described column by column: rate of null (empty) and blank (only spaces) values, number of
+// distinct values and the most frequent ones, shortest and longest value, pattern classes of the values
+// (digits, letters, mixed or symbols only) and the rate of values parsing as dates or amounts. The profile
+// is produced by the profile subcommand or before the submission with the -profile option, as json and as
+// a readable table.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// base name of the files inside the work folder where the profile is saved (.json and .txt).
+const profileFilename = "profile"
+
+// if true then the source file is profiled before being processed.
+var profileMode bool
+
+// number of most frequent values kept for each column.
+var profileTop = 5
+
+// ValueCount is a value of a column with its number of occurrences.
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// PatternCounts counts the values of a column by the classes of characters they hold.
+type PatternCounts struct {
+	// values with digits and no letters like 38002, $10 or 01/04/2016.
+	Digits int `json:"digits"`
+	// values with letters and no digits like Warsaw.
+	Letters int `json:"letters"`
+	// values with both letters and digits like 12 Main Street.
+	Mixed int `json:"mixed"`
+	// values without any letter nor digit like - or $.
+	Symbols int `json:"symbols"`
+}
+
+// ColumnProfile describes the values of a column.
+type ColumnProfile struct {
+	Name       string        `json:"name"`
+	Count      int           `json:"count"`
+	Null       int           `json:"null"`
+	Blank      int           `json:"blank"`
+	NullRate   float64       `json:"null_rate"`
+	BlankRate  float64       `json:"blank_rate"`
+	Distinct   int           `json:"distinct"`
+	Top        []ValueCount  `json:"top_values"`
+	MinLength  int           `json:"min_length"`
+	MaxLength  int           `json:"max_length"`
+	Patterns   PatternCounts `json:"patterns"`
+	DateRate   float64       `json:"date_rate"`
+	AmountRate float64       `json:"amount_rate"`
+}
+
+// FileProfile describes the columns of an input file.
+type FileProfile struct {
+	Source  string          `json:"source"`
+	Time    time.Time       `json:"time"`
+	Rows    int             `json:"rows"`
+	Columns []ColumnProfile `json:"columns"`
+}
+
+// patternOf is a function that counts the value into the class of characters it holds.
+func patternOf(value string, counts *PatternCounts) {
+	var digits, letters bool
+	for _, r := range value {
+		switch {
+		case unicode.IsDigit(r):
+			digits = true
+		case unicode.IsLetter(r):
+			letters = true
+		}
+	}
+	switch {
+	case digits && letters:
+		counts.Mixed++
+	case digits:
+		counts.Digits++
+	case letters:
+		counts.Letters++
+	default:
+		counts.Symbols++
+	}
+}
+
+// rate is a function that returns the part of the total - 0 when the total is 0.
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// ProfileColumns is a function that profiles the rows of a file whose first row holds the headers.
+// Rows shorter than the headers count as null values for the missing columns. Dates are parsed with
+// the layouts and amounts without symbol get the currency.
+func ProfileColumns(rows [][]string, layouts []string, currency string, top int) []ColumnProfile {
+	if len(rows) == 0 {
+		return nil
+	}
+	header, data := rows[0], rows[1:]
+	columns := make([]ColumnProfile, len(header))
+	for i, name := range header {
+		c := ColumnProfile{Name: strings.TrimSpace(name), Count: len(data), MinLength: -1}
+		frequencies := make(map[string]int)
+		var dates, amounts int
+		for _, row := range data {
+			if i >= len(row) || row[i] == "" {
+				c.Null++
+				continue
+			}
+			value := row[i]
+			if strings.TrimSpace(value) == "" {
+				c.Blank++
+				continue
+			}
+			frequencies[value]++
+			length := utf8.RuneCountInString(value)
+			if c.MinLength == -1 || length < c.MinLength {
+				c.MinLength = length
+			}
+			if length > c.MaxLength {
+				c.MaxLength = length
+			}
+			patternOf(value, &c.Patterns)
+			if _, err := ParseDate(value, layouts); err == nil {
+				dates++
+			}
+			if _, err := ParseAmount(value, currency); err == nil {
+				amounts++
+			}
+		}
+		if c.MinLength == -1 {
+			c.MinLength = 0
+		}
+		values := c.Count - c.Null - c.Blank
+		c.NullRate, c.BlankRate = rate(c.Null, c.Count), rate(c.Blank, c.Count)
+		c.DateRate, c.AmountRate = rate(dates, values), rate(amounts, values)
+		c.Distinct = len(frequencies)
+
+		c.Top = make([]ValueCount, 0, len(frequencies))
+		for value, n := range frequencies {
+			c.Top = append(c.Top, ValueCount{Value: value, Count: n})
+		}
+		sort.Slice(c.Top, func(a, b int) bool {
+			if c.Top[a].Count != c.Top[b].Count {
+				return c.Top[a].Count > c.Top[b].Count
+			}
+			return c.Top[a].Value < c.Top[b].Value
+		})
+		if len(c.Top) > top {
+			c.Top = c.Top[:top]
+		}
+		columns[i] = c
+	}
+	return columns
+}
+
+// percent is a function that formats a rate as a percentage for the table.
+func percent(r float64) string {
+	return fmt.Sprintf("%.1f%%", r*100)
+}
+
+// shorten is a function that cuts a value to the given number of characters for the table.
+func shorten(value string, max int) string {
+	if utf8.RuneCountInString(value) <= max {
+		return value
+	}
+	return string([]rune(value)[:max-1]) + "…"
+}
+
+// WriteTable writes the profile as a readable table.
+func (p FileProfile) WriteTable(out io.Writer) error {
+	fmt.Fprintf(out, "Profile of %s - %d rows / %d columns\n\n", p.Source, p.Rows, len(p.Columns))
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COLUMN\tNULL\tBLANK\tDISTINCT\tLENGTH\tDIGITS/LETTERS/MIXED/SYMBOLS\tDATES\tAMOUNTS\tTOP VALUES")
+	for _, c := range p.Columns {
+		top := make([]string, 0, len(c.Top))
+		for _, v := range c.Top {
+			top = append(top, fmt.Sprintf("%s (%d)", shorten(v.Value, 20), v.Count))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d-%d\t%d/%d/%d/%d\t%s\t%s\t%s\n", shorten(c.Name, 20), percent(c.NullRate), percent(c.BlankRate),
+			c.Distinct, c.MinLength, c.MaxLength, c.Patterns.Digits, c.Patterns.Letters, c.Patterns.Mixed, c.Patterns.Symbols,
+			percent(c.DateRate), percent(c.AmountRate), strings.Join(top, ", "))
+	}
+	return w.Flush()
+}
+
+// newFileProfile is a function that profiles the rows of a source with the options of the run.
+func newFileProfile(source string, rows [][]string) FileProfile {
+	p := FileProfile{Source: source, Time: time.Now().UTC(), Columns: ProfileColumns(rows, splitList(dateLayouts), currencyCode, profileTop)}
+	if len(rows) > 0 {
+		p.Rows = len(rows) - 1
+	}
+	return p
+}
+
+// saveProfile is a function that writes the profile into the profile.json and profile.txt files of the work folder.
+func saveProfile(folder string, p FileProfile) error {
+	base := folder + string(os.PathSeparator) + profileFilename
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(base+".json", data, 0644); err != nil {
+		return err
+	}
+	f, err := os.Create(base + ".txt")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.WriteTable(f)
+}
+
+// profileRecords is a function that profiles the raw records of the source file (headers included)
+// before their processing and saves the profile into the work folder.
+func profileRecords(records [][]string) {
+	setStage("profile")
+	fmt.Print("\n\t[+] profiling the columns of the source file ... ")
+	logInfos.Println("profiling of the source file columns started.")
+	if err := saveProfile(workFolder, newFileProfile(sourceURL, records)); err != nil {
+		fmt.Print("[ FAILURE ]\n\n\t[-] please check log file for more detailed reason. // ")
+		logError.Fatalf("failed to save the profile - Errmsg: %v", err)
+	}
+	logInfos.Printf("profiling completed and saved into %s.json and %s.txt.\n", profileFilename, profileFilename)
+	fmt.Println("[ SUCCESS ]")
+}
+
+const profileUsage = `Usage:
+
+    eprocessor profile <csv file | url> [profile options]
+
+Profile options:
+    -format        Output format - table (default) or json.
+    -top           Number of most frequent values shown for each column (default 5).
+    -date-layouts  Comma separated Go layouts of the dates (default 01/02/2006).
+    -currency      ISO 4217 code of the amounts without currency symbol (default USD).
+
+The first row of the file holds the names of the columns. Urls could be http, https or file.
+`
+
+// readSource is a function that reads the rows of a local csv file or of a csv file behind an url.
+func readSource(source string) ([][]string, error) {
+	var in io.Reader
+	if strings.Contains(source, "://") {
+		client := &http.Client{Transport: sourceTransport(), Timeout: 5 * time.Minute}
+		response, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", response.Status)
+		}
+		in = response.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+	reader := csv.NewReader(in)
+	// partner files could have rows of different lengths.
+	reader.FieldsPerRecord = -1
+	return reader.ReadAll()
+}
+
+// runProfile is a function that prints the profile of a file. It returns the exit code of the program.
+func runProfile(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintf(os.Stderr, "%s\n", profileUsage)
+		return exitCodeConfig
+	}
+	fs := flag.NewFlagSet("profile", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", profileUsage) }
+	format := fs.String("format", "table", "")
+	fs.IntVar(&profileTop, "top", profileTop, "")
+	fs.StringVar(&dateLayouts, "date-layouts", defaultDateLayouts, "")
+	fs.StringVar(&currencyCode, "currency", defaultCurrency, "")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 || profileTop < 0 || (*format != "table" && *format != "json") {
+		return exitCodeConfig
+	}
+
+	rows, err := readSource(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nFailed to read %s - Errmsg: %v\n", args[0], err)
+		return exitCodeError
+	}
+	p := newFileProfile(args[0], rows)
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(p); err != nil {
+			return exitCodeError
+		}
+		return exitCodeSuccess
+	}
+	if err := p.WriteTable(os.Stdout); err != nil {
+		return exitCodeError
+	}
+	return exitCodeSuccess
+}
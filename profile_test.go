@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestProfileColumns(t *testing.T) {
+	rows := [][]string{
+		{"Date", "Name", "Amount", "Memo"},
+		{"01/04/2016", "Jerome AMON", "$10", ""},
+		{"01/05/2016", "Jerome AMON", "$20", "  "},
+		{"2016-01-06", "Anna", "ten", "-"},
+		{"01/04/2016", "Ana 2"},
+	}
+	columns := ProfileColumns(rows, []string{"01/02/2006"}, "USD", 2)
+	if len(columns) != 4 {
+		t.Fatalf("got %d columns, wanted 4", len(columns))
+	}
+
+	date := columns[0]
+	if date.Count != 4 || date.Distinct != 3 || date.DateRate != 0.75 || date.Patterns.Digits != 4 || date.MinLength != 10 || date.MaxLength != 10 {
+		t.Errorf("unexpected date column %+v", date)
+	}
+	if len(date.Top) != 2 || date.Top[0] != (ValueCount{"01/04/2016", 2}) || date.Top[1] != (ValueCount{"01/05/2016", 1}) {
+		t.Errorf("unexpected top dates %+v", date.Top)
+	}
+
+	name := columns[1]
+	if name.Patterns.Letters != 3 || name.Patterns.Mixed != 1 || name.MinLength != 4 || name.MaxLength != 11 {
+		t.Errorf("unexpected name column %+v", name)
+	}
+
+	amount := columns[2]
+	if amount.Null != 1 || amount.NullRate != 0.25 || amount.AmountRate != 2.0/3 {
+		t.Errorf("unexpected amount column %+v", amount)
+	}
+
+	memo := columns[3]
+	if memo.Null != 2 || memo.Blank != 1 || memo.Patterns.Symbols != 1 || memo.Distinct != 1 {
+		t.Errorf("unexpected memo column %+v", memo)
+	}
+
+	var out bytes.Buffer
+	p := FileProfile{Source: "data.csv", Rows: 4, Columns: columns}
+	if err := p.WriteTable(&out); err != nil {
+		t.Fatal(err)
+	}
+	table := out.String()
+	for _, want := range []string{"Profile of data.csv - 4 rows / 4 columns", "COLUMN", "01/04/2016 (2)", "75.0%"} {
+		if !strings.Contains(table, want) {
+			t.Errorf("table does not hold %q:\n%s", want, table)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+// This file contains the reconcile subcommand. After a run, it tells whether the backend really holds every
+// record. The source file is processed like a normal run (without the ledger) then the records are fetched
+// from a list endpoint of the API page by page and both sides are matched by fingerprint. The fingerprint is
+// built from the -match-keys fields (the deduplication fields by default) so records holding the same keys
+// but different values are reported as mismatched. Missing, extra and mismatched records are saved into the
+// reconcile.csv report of the work folder and the missing ones could be submitted again with -resubmit.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// name of the file inside the work folder where the reconciliation differences are saved.
+const reconcileFilename = "reconcile.csv"
+
+// maximum number of pages fetched from the list endpoint.
+const maxReconcilePages = 100000
+
+// possible statuses of a reconciled record.
+const (
+	reconcileMissing    = "missing"
+	reconcileExtra      = "extra"
+	reconcileMismatched = "mismatched"
+	reconcileUnreadable = "unreadable"
+)
+
+// if true then the downloaded file is reconciled with the backend instead of being submitted.
+var reconcileMode bool
+
+// this stores the url of the endpoint listing the records of the backend - the api url by default.
+var listURL string
+
+// number of records requested per page of the list endpoint.
+var pageSize int
+
+// indexes of the fields used to match local and remote records - the deduplication fields when empty.
+var matchKeys []int
+
+// if true then the records missing on the backend are submitted again.
+var resubmitMissing bool
+
+// outcome of the reconciliation of the current run for the summary.
+var reconcileCounts *ReconcileCounts
+
+// ReconcileCounts holds the outcome of a reconciliation.
+type ReconcileCounts struct {
+	Local       int `json:"local"`
+	Remote      int `json:"remote"`
+	Matched     int `json:"matched"`
+	Missing     int `json:"missing"`
+	Extra       int `json:"extra"`
+	Mismatched  int `json:"mismatched"`
+	Unreadable  int `json:"unreadable"`
+	Resubmitted int `json:"resubmitted"`
+}
+
+// InSync reports if the backend holds exactly the local records, once the missing ones
+// have been submitted again.
+func (c ReconcileCounts) InSync() bool {
+	return c.Extra == 0 && c.Mismatched == 0 && c.Unreadable == 0 && c.Missing == c.Resubmitted
+}
+
+// A reconcileEntry is a difference between the local and the remote records.
+type reconcileEntry struct {
+	status      string
+	fingerprint string
+	// list of the fields holding different values.
+	differences string
+	// local record for the missing and mismatched entries, remote one otherwise.
+	record Record
+	raw    string
+}
+
+// listPageURL is a function that adds the page number and the page size to the query of the list url.
+func listPageURL(base string, page, size int) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("page", strconv.Itoa(page))
+	q.Set("limit", strconv.Itoa(size))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// decodeListPage is a function that extracts the records of a page of the list endpoint. A page is
+// either a json array of records or an object holding them under the records, items or data field
+// with an optional next field giving the url of the next page and an optional total field giving the
+// number of records of all pages. The total is -1 when not reported.
+func decodeListPage(body io.Reader) ([]json.RawMessage, string, int, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, "", -1, err
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err == nil {
+		return items, "", -1, nil
+	}
+	var page struct {
+		Records []json.RawMessage `json:"records"`
+		Items   []json.RawMessage `json:"items"`
+		Data    []json.RawMessage `json:"data"`
+		Next    string            `json:"next"`
+		Total   *int              `json:"total"`
+	}
+	if err := json.Unmarshal(raw, &page); err != nil {
+		return nil, "", -1, fmt.Errorf("unexpected page format - expected an array or an object with records")
+	}
+	total := -1
+	if page.Total != nil {
+		total = *page.Total
+	}
+	switch {
+	case page.Records != nil:
+		items = page.Records
+	case page.Items != nil:
+		items = page.Items
+	default:
+		items = page.Data
+	}
+	return items, page.Next, total, nil
+}
+
+// fetchRemoteRecords is a function that gets all records of the list endpoint page by page. It
+// follows the next url of the pages when provided until a page has none, otherwise it requests the
+// following page number until a page is empty or the total reported by the API is reached. A short
+// page does not end the listing since the API could cap the page size below the requested one.
+func fetchRemoteRecords(base, key string, size int) ([]json.RawMessage, error) {
+	client := &http.Client{Timeout: timeout * time.Second}
+	var all []json.RawMessage
+	next := ""
+	for page := 1; page <= maxReconcilePages; page++ {
+		pageURL := next
+		if pageURL == "" {
+			var err error
+			if pageURL, err = listPageURL(base, page, size); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequest(http.MethodGet, pageURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-API-KEY", key)
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("page %d: unexpected status %s", page, resp.Status)
+		}
+		items, nextURL, total, err := decodeListPage(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %v", page, err)
+		}
+		all = append(all, items...)
+
+		if nextURL != "" {
+			// the next url could be relative to the current page.
+			u, err := url.Parse(pageURL)
+			if err != nil {
+				return nil, err
+			}
+			n, err := u.Parse(nextURL)
+			if err != nil {
+				return nil, err
+			}
+			next = n.String()
+			continue
+		}
+		if next != "" || len(items) == 0 || (total >= 0 && len(all) >= total) {
+			return all, nil
+		}
+	}
+	return nil, fmt.Errorf("more than %d pages listed", maxReconcilePages)
+}
+
+// decodeRemoteRecord is a function that reads a remote record which could be wrapped into a
+// PaymentRecord object like the submitted payloads or not.
+func decodeRemoteRecord(raw json.RawMessage) (Record, bool) {
+	var wrapped struct {
+		PaymentRecord *Record `json:"PaymentRecord"`
+	}
+	if err := json.Unmarshal(raw, &wrapped); err == nil && wrapped.PaymentRecord != nil {
+		return *wrapped.PaymentRecord, true
+	}
+	var r Record
+	if err := json.Unmarshal(raw, &r); err != nil || r == (Record{}) {
+		return Record{}, false
+	}
+	return r, true
+}
+
+// recordDifferences is a function that lists the fields which differ between two records. The import
+// date is never compared since it changes at each run.
+func recordDifferences(local, remote Record, normalize bool) []string {
+	var diffs []string
+	l, r := local.fields(), remote.fields()
+	for i, name := range fieldNames {
+		if name == "importdate" {
+			continue
+		}
+		a, b := l[i], r[i]
+		if normalize {
+			a, b = normalizeValue(a), normalizeValue(b)
+		}
+		if a != b {
+			diffs = append(diffs, fmt.Sprintf("%s: %q != %q", name, l[i], r[i]))
+		}
+	}
+	return diffs
+}
+
+// pairRecords is a function that pairs each record of the second list with a record of the first
+// list holding the same fingerprint computed with the options. Several records could share a
+// fingerprint when it is built from a subset of fields so identical records are paired first. It
+// returns for each record of the second list the index of its pair into the first one or -1.
+func pairRecords(first, second []Record, opts DedupOptions) []int {
+	groups := make(map[string][]int)
+	for i, r := range first {
+		fp := Fingerprint(r.fields(), opts)
+		groups[fp] = append(groups[fp], i)
+	}
+	fingerprints := make([]string, len(second))
+	pairs := make([]int, len(second))
+	for j, r := range second {
+		fingerprints[j], pairs[j] = Fingerprint(r.fields(), opts), -1
+	}
+
+	paired := make([]bool, len(first))
+	for _, identical := range []bool{true, false} {
+		for j, r := range second {
+			if pairs[j] != -1 {
+				continue
+			}
+			for _, i := range groups[fingerprints[j]] {
+				if !paired[i] && (!identical || len(recordDifferences(first[i], r, opts.Normalize)) == 0) {
+					paired[i], pairs[j] = true, i
+					break
+				}
+			}
+		}
+	}
+	return pairs
+}
+
+// Reconcile is a function that matches the local records with the remote ones by their fingerprint
+// computed with the options. Remote records left without pair are extra. It returns the counts and
+// the differences: missing records in local order, then mismatched and extra ones in remote order,
+// then unreadable ones.
+func Reconcile(local []Record, remote []json.RawMessage, opts DedupOptions) (ReconcileCounts, []reconcileEntry) {
+	counts := ReconcileCounts{Local: len(local), Remote: len(remote)}
+	var records []Record
+	var unreadable []reconcileEntry
+	for _, raw := range remote {
+		r, ok := decodeRemoteRecord(raw)
+		if !ok {
+			counts.Unreadable++
+			unreadable = append(unreadable, reconcileEntry{status: reconcileUnreadable, raw: string(raw)})
+			continue
+		}
+		records = append(records, r)
+	}
+
+	var others []reconcileEntry
+	paired := make([]bool, len(local))
+	for j, i := range pairRecords(local, records, opts) {
+		r := records[j]
+		if i == -1 {
+			counts.Extra++
+			others = append(others, reconcileEntry{status: reconcileExtra, fingerprint: Fingerprint(r.fields(), opts), record: r})
+			continue
+		}
+		paired[i] = true
+		if diffs := recordDifferences(local[i], r, opts.Normalize); len(diffs) > 0 {
+			counts.Mismatched++
+			others = append(others, reconcileEntry{status: reconcileMismatched, fingerprint: Fingerprint(r.fields(), opts), differences: strings.Join(diffs, "; "), record: local[i]})
+			continue
+		}
+		counts.Matched++
+	}
+
+	var entries []reconcileEntry
+	for i, r := range local {
+		if !paired[i] {
+			counts.Missing++
+			entries = append(entries, reconcileEntry{status: reconcileMissing, fingerprint: Fingerprint(r.fields(), opts), record: r})
+		}
+	}
+	return counts, append(append(entries, others...), unreadable...)
+}
+
+// saveReconcileReport is a function that writes the differences into the reconcile.csv file.
+func saveReconcileReport(folder string, entries []reconcileEntry) error {
+	f, err := os.Create(folder + string(os.PathSeparator) + reconcileFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write(append([]string{"status", "fingerprint", "differences", "raw"}, fieldNames...))
+	for _, e := range entries {
+		row := []string{e.status, e.fingerprint, e.differences, e.raw}
+		if e.status == reconcileUnreadable {
+			row = append(row, make([]string, len(fieldNames))...)
+		} else {
+			row = append(row, e.record.fields()...)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// reconcileFile is a function that prepares the records of the csv file, matches them with the records
+// listed by the backend, saves the differences and submits again the missing records when enabled.
+func reconcileFile(filepath, importDate string) {
+	allRecords, initNumOfRecords, ok := prepareRecords(filepath, importDate)
+	if !ok {
+		// an empty file would report every remote record as extra.
+		return
+	}
+	local := make([]Record, 0, len(allRecords))
+	for _, record := range allRecords {
+		local = append(local, newRecord(record))
+	}
+
+	setStage("reconcile")
+	fmt.Printf("\n\t[+] fetching the records listed by %s ... ", listURL)
+	logInfos.Printf("fetching of the records listed by %s started.\n", listURL)
+	remote, err := fetchRemoteRecords(listURL, apiKEY, pageSize)
+	if err != nil {
+		fmt.Print("[ FAILURE ]\n\n\t[-] please check log file for more detailed reason. // ")
+		logError.Fatalf("failed to fetch the remote records - Errmsg: %v", err)
+	}
+	logInfos.Printf("fetching of %d remote records successfully completed.\n", len(remote))
+	fmt.Printf("[ SUCCESS ] [ %d RECORDS ]\n", len(remote))
+
+	fmt.Print("\n\t[+] matching local and remote records ... ")
+	opts := dedupOptions
+	if len(matchKeys) > 0 {
+		opts.Keys = matchKeys
+	}
+	counts, entries := Reconcile(local, remote, opts)
+	if err := saveReconcileReport(workFolder, entries); err != nil {
+		fmt.Print("[ FAILURE ]\n\n\t[-] please check log file for more detailed reason. // ")
+		logError.Fatalf("failed to save the reconciliation report - Errmsg: %v", err)
+	}
+	keys := describeFields(opts.Keys)
+	if keys == "" {
+		keys = "all"
+	}
+	logInfos.Printf("reconciliation on %s fields completed - matched: %d / missing: %d / extra: %d / mismatched: %d / unreadable: %d.\n", keys, counts.Matched, counts.Missing, counts.Extra, counts.Mismatched, counts.Unreadable)
+	fmt.Println("[ SUCCESS ]")
+	fmt.Printf("\n\t[+] Local: %d / Remote: %d / matched: %d / missing: %d / extra: %d / mismatched: %d / unreadable: %d\n", counts.Local, counts.Remote, counts.Matched, counts.Missing, counts.Extra, counts.Mismatched, counts.Unreadable)
+	reconcileCounts = &counts
+
+	if !resubmitMissing || counts.Missing == 0 {
+		return
+	}
+	var missing []Record
+	for _, e := range entries {
+		if e.status == reconcileMissing {
+			missing = append(missing, e.record)
+		}
+	}
+	counts.Resubmitted = len(missing)
+	reconcileCounts = &counts
+	// records not submitted again are part of the skipped ones for the summary.
+	atomic.AddInt64(&metrics.skipped, int64(len(local)-len(missing)))
+	setStage("submission")
+	submitRecords(missing, initNumOfRecords)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	john := Record{Date: "01/04/2016", Name: "John", Amount: "$10", City: "Warsaw", ImportDate: "10/01/2021"}
+	jane := Record{Date: "01/04/2016", Name: "Jane", Amount: "$20", City: "Krakow", ImportDate: "10/01/2021"}
+	joe := Record{Date: "02/04/2016", Name: "Joe", Amount: "$30", City: "Gdansk", ImportDate: "10/01/2021"}
+	local := []Record{john, jane, joe}
+
+	encode := func(r Record, wrapped bool) json.RawMessage {
+		var data []byte
+		if wrapped {
+			data, _ = json.Marshal(PaymentRecord{PaymentRecord: r})
+		} else {
+			data, _ = json.Marshal(r)
+		}
+		return data
+	}
+	movedJane := jane
+	movedJane.City, movedJane.ImportDate = "Lodz", "10/02/2021"
+	// the import date of the remote record is never compared.
+	johnLater := john
+	johnLater.ImportDate = "10/02/2021"
+	remote := []json.RawMessage{
+		encode(movedJane, true),
+		encode(johnLater, false),
+		encode(Record{Name: "Unknown", Amount: "$1"}, true),
+		json.RawMessage(`{"id": 12}`),
+	}
+
+	opts := DedupOptions{Keys: []int{0, 1, 9}}
+	counts, entries := Reconcile(local, remote, opts)
+	want := ReconcileCounts{Local: 3, Remote: 4, Matched: 1, Missing: 1, Extra: 1, Mismatched: 1, Unreadable: 1}
+	if counts != want {
+		t.Errorf("got counts %+v, wanted %+v", counts, want)
+	}
+	var statuses []string
+	for _, e := range entries {
+		statuses = append(statuses, e.status)
+	}
+	if got := strings.Join(statuses, ","); got != "missing,mismatched,extra,unreadable" {
+		t.Errorf("got entries %s", got)
+	}
+	if entries[0].record != joe || entries[1].differences != `city: "Krakow" != "Lodz"` {
+		t.Errorf("unexpected entries %+v", entries[:2])
+	}
+	if counts.InSync() {
+		t.Error("differences reported as in sync")
+	}
+
+	// records sharing the match keys are paired identical ones first.
+	janeAgain := jane
+	janeAgain.City = "Lodz"
+	counts, _ = Reconcile([]Record{janeAgain, jane}, []json.RawMessage{encode(jane, true), encode(janeAgain, true), encode(jane, true)}, opts)
+	want = ReconcileCounts{Local: 2, Remote: 3, Matched: 2, Extra: 1}
+	if counts != want {
+		t.Errorf("got counts %+v for duplicates, wanted %+v", counts, want)
+	}
+
+	counts, _ = Reconcile(local, nil, DedupOptions{})
+	counts.Resubmitted = counts.Missing
+	if counts.Missing != 3 || !counts.InSync() {
+		t.Errorf("got counts %+v, wanted all records missing then resubmitted", counts)
+	}
+}
+
+func TestFetchRemoteRecords(t *testing.T) {
+	var records []string
+	for i := 0; i < 7; i++ {
+		records = append(records, fmt.Sprintf(`{"PaymentRecord":{"name":"n%d"}}`, i))
+	}
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("X-API-KEY") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		// the capped api never returns more than 2 records per page.
+		if r.URL.Path == "/capped" && limit > 2 {
+			limit = 2
+		}
+		start, end := (page-1)*limit, page*limit
+		if start > len(records) {
+			start = len(records)
+		}
+		if end > len(records) {
+			end = len(records)
+		}
+		items := "[" + strings.Join(records[start:end], ",") + "]"
+		if r.URL.Path == "/total" {
+			fmt.Fprintf(w, `{"data":%s,"total":%d}`, items, len(records))
+			return
+		}
+		if r.URL.Path == "/cursor" {
+			next := ""
+			if end < len(records) {
+				next = fmt.Sprintf("/cursor?page=%d&limit=%d", page+1, limit)
+			}
+			fmt.Fprintf(w, `{"records":%s,"next":%q}`, items, next)
+			return
+		}
+		fmt.Fprint(w, items)
+	}))
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		path     string
+		size     int
+		requests int
+	}{{"/records", 3, 4}, {"/records", 7, 2}, {"/cursor", 3, 3}, {"/total", 3, 3}, {"/total", 7, 1}, {"/capped", 3, 5}} {
+		requests = 0
+		items, err := fetchRemoteRecords(ts.URL+tt.path, "key", tt.size)
+		if err != nil || len(items) != len(records) || requests != tt.requests {
+			t.Errorf("%s by %d: got %d records into %d requests (%v), wanted %d into %d", tt.path, tt.size, len(items), requests, err, len(records), tt.requests)
+		}
+	}
+	if _, err := fetchRemoteRecords(ts.URL+"/records", "bad", 3); err == nil {
+		t.Error("unauthorized listing did not fail")
+	}
+}
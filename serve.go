@@ -0,0 +1,501 @@
+package main
+
+// This file contains the serve subcommand. It exposes a small REST API so that other services could start
+// an import on demand (e.g. right after an upstream export) instead of waiting for the daemon schedule:
+//
+//	POST /runs                 start a run - optional json body {"source": "<url>"} overrides the source.
+//	GET  /runs                 list the runs started since the server is up, latest first.
+//	GET  /runs/{id}            status of a run with its live counts while running and its summary once done.
+//	GET  /runs/{id}/failures   failed records of a run with their error from its work folder.
+//	POST /runs/{id}/cancel     cancel a running run (DELETE /runs/{id} works too).
+//
+// Like the daemon, each run is a child process of the program into batch mode with its own work folder and
+// only one run goes at a time. Live counts are read from the metrics endpoint of the child process.
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const serveUsage = `Usage:
+
+    eprocessor serve [serve options] [-- pipeline options]
+
+Serve options:
+    -addr              Address where the REST API is served (default :8082).
+    -auth-key          Value expected into the 'X-API-KEY' header of the requests - no authentication by default.
+    -shutdown-timeout  Maximum time to wait for the current run on SIGTERM before canceling it (default 5m).
+
+Pipeline options are the options of each run (e.g. -api, -key, -source, -sinks). The -api, -key and
+-source options not provided are loaded from the EPROCESSOR_* environment variables.
+
+Routes:
+    POST /runs                 Start a run. An optional json body {"source": "<url>"} overrides the source url.
+    GET  /runs                 List the runs started since the server is up, latest first.
+    GET  /runs/{id}            Status of a run with its live counts while running and its summary once done.
+    GET  /runs/{id}/failures   Failed records of a run with their error.
+    POST /runs/{id}/cancel     Cancel a running run - DELETE /runs/{id} works too.
+`
+
+// states of a run started through the API.
+const (
+	runRunning  = "running"
+	runFinished = "finished"
+	runCanceled = "canceled"
+)
+
+// maximum number of runs kept into the history of the server.
+const maxServedRuns = 100
+
+// An apiRun is a run started through the API.
+type apiRun struct {
+	ID     string           `json:"id"`
+	State  string           `json:"state"`
+	Source string           `json:"source,omitempty"`
+	Counts map[string]int64 `json:"live_counts,omitempty"`
+	runStatus
+
+	metricsAddr string
+	before      map[string]bool
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+// runFailure is a failed record of a run.
+type runFailure struct {
+	CID    string          `json:"cid,omitempty"`
+	Status int             `json:"http_status,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Record json.RawMessage `json:"record,omitempty"`
+}
+
+// A Server starts runs on demand and serves their status.
+type Server struct {
+	// executes one run with the source override and the metrics address of the child process.
+	run     func(ctx context.Context, number int, source, metricsAddr string) runStatus
+	authKey string
+	logger  *log.Logger
+
+	mu       sync.Mutex
+	runs     map[string]*apiRun
+	order    []string
+	active   *apiRun
+	number   int
+	stopping bool
+}
+
+// newServer is a function that creates a server which executes the runs with the run function.
+func newServer(run func(ctx context.Context, number int, source, metricsAddr string) runStatus, authKey string, logger *log.Logger) *Server {
+	return &Server{run: run, authKey: authKey, logger: logger, runs: make(map[string]*apiRun)}
+}
+
+// serveRun is a function that returns a run function executing the program as a child process with the
+// pipeline arguments, the source override if any and the metrics endpoint used for the live counts.
+func serveRun(executable string, args []string) func(ctx context.Context, number int, source, metricsAddr string) runStatus {
+	return func(ctx context.Context, number int, source, metricsAddr string) runStatus {
+		runArgs := append([]string(nil), args...)
+		if source != "" {
+			runArgs = append(runArgs, "-source", source)
+		}
+		if metricsAddr != "" {
+			runArgs = append(runArgs, "-metrics-addr", metricsAddr)
+		}
+		return childRun(executable, runArgs)(ctx, number)
+	}
+}
+
+// freeAddr is a function that returns a local address with a free tcp port.
+func freeAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return ""
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// errServerStopping is returned when a run is requested while the server stops.
+var errServerStopping = errors.New("the server is stopping")
+
+// Start starts a new run into background. It fails when a run is already going.
+func (s *Server) Start(source string) (*apiRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return nil, errServerStopping
+	}
+	if s.active != nil {
+		return s.active, fmt.Errorf("run %s is already in progress", s.active.ID)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.number++
+	r := &apiRun{
+		ID:          generateID(),
+		State:       runRunning,
+		Source:      source,
+		runStatus:   runStatus{Number: s.number, Start: time.Now()},
+		metricsAddr: freeAddr(),
+		before:      workFolders(),
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	s.runs[r.ID] = r
+	s.order = append(s.order, r.ID)
+	if len(s.order) > maxServedRuns {
+		delete(s.runs, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.active = r
+
+	go func() {
+		defer close(r.done)
+		s.logger.Printf("run %s started.\n", r.ID)
+		status := s.run(ctx, r.Number, source, r.metricsAddr)
+		s.mu.Lock()
+		r.runStatus = status
+		if r.State == runRunning {
+			r.State = runFinished
+		}
+		r.Counts = nil
+		s.active = nil
+		s.mu.Unlock()
+		cancel()
+		s.logger.Printf("run %s %s with %s status (exit code %d) into %q.\n", r.ID, r.State, status.ExitStatus, status.ExitCode, status.WorkFolder)
+	}()
+	return r, nil
+}
+
+// Cancel cancels a running run. It reports false when the run is already done.
+func (s *Server) Cancel(r *apiRun) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.State != runRunning {
+		return false
+	}
+	r.State = runCanceled
+	r.cancel()
+	return true
+}
+
+// Stop refuses new runs and waits for the end of the current run if any. The run is canceled
+// when it does not finish before the timeout.
+func (s *Server) Stop(timeout time.Duration) {
+	s.mu.Lock()
+	s.stopping = true
+	r := s.active
+	s.mu.Unlock()
+	if r == nil {
+		return
+	}
+	s.logger.Printf("waiting up to %s for the run %s to finish.\n", timeout, r.ID)
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+		s.Cancel(r)
+		<-r.done
+	}
+}
+
+// snapshot returns a copy of the run. The work folder and the live counts of a running run are
+// looked up at each call.
+func (s *Server) snapshot(r *apiRun) apiRun {
+	s.mu.Lock()
+	c := *r
+	s.mu.Unlock()
+	if c.State != runRunning {
+		return c
+	}
+	if c.WorkFolder == "" {
+		c.WorkFolder = newWorkFolder(c.before)
+		s.mu.Lock()
+		if r.WorkFolder == "" {
+			r.WorkFolder = c.WorkFolder
+		}
+		s.mu.Unlock()
+	}
+	if counts, err := scrapeCounts(c.metricsAddr); err == nil {
+		c.Counts = counts
+	}
+	return c
+}
+
+// scrapeCounts is a function that reads the records counters and the number of busy workers from
+// the metrics endpoint of a running child process.
+func scrapeCounts(addr string) (map[string]int64, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("no metrics endpoint")
+	}
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Get("http://" + addr + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	counts := make(map[string]int64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		name := fields[0]
+		switch {
+		case strings.HasPrefix(name, "eprocessor_records_") && strings.HasSuffix(name, "_total"):
+			name = strings.TrimSuffix(strings.TrimPrefix(name, "eprocessor_records_"), "_total")
+		case name == "eprocessor_inflight_workers":
+			name = "inflight"
+		default:
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			counts[name] = v
+		}
+	}
+	return counts, scanner.Err()
+}
+
+// readFailures is a function that returns the failed records of the statistics.log file of a work
+// folder with the error of each call found into the details.log file. Both text and json formats
+// are supported.
+func readFailures(folder string) ([]runFailure, error) {
+	errs := make(map[string]string)
+	err := scanLines(filepath.Join(folder, "details.log"), func(line string) {
+		if strings.HasPrefix(line, "{") {
+			var entry logEntry
+			if json.Unmarshal([]byte(line), &entry) == nil && entry.Level == "error" && entry.CID != "" {
+				errs[entry.CID] = entry.Error
+			}
+			return
+		}
+		m := idPattern.FindStringSubmatch(line)
+		if i := strings.Index(line, "Errmsg: "); m != nil && i != -1 && strings.HasPrefix(line, "[ ERROR ]") {
+			errs[m[1]] = strings.TrimSpace(line[i+len("Errmsg: "):])
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	failures := []runFailure{}
+	err = scanLines(filepath.Join(folder, "statistics.log"), func(line string) {
+		var f runFailure
+		if strings.HasPrefix(line, "{") {
+			var entry logEntry
+			if json.Unmarshal([]byte(line), &entry) != nil || entry.Level != "failure" {
+				return
+			}
+			f = runFailure{CID: entry.CID, Status: entry.Status, Record: entry.Record}
+		} else if i := strings.Index(line, "{"); strings.HasPrefix(line, "[ FAILURE ]") && i != -1 {
+			if m := idPattern.FindStringSubmatch(line); m != nil {
+				f.CID = m[1]
+			}
+			if json.Valid([]byte(line[i:])) {
+				f.Record = json.RawMessage(line[i:])
+			}
+		} else {
+			return
+		}
+		f.Error = errs[f.CID]
+		failures = append(failures, f)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return failures, nil
+}
+
+// scanLines is a function that calls fn with each line of a file.
+func scanLines(path string, fn func(line string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// writeJSON writes the value as json response with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError writes an error message as json response with the status code.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// ServeHTTP routes the requests of the REST API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.authKey != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-KEY")), []byte(s.authKey)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid or missing X-API-KEY header")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "runs" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, "unknown route")
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodPost:
+			s.handleStart(w, r)
+		case http.MethodGet:
+			s.mu.Lock()
+			ids := append([]string(nil), s.order...)
+			s.mu.Unlock()
+			list := []apiRun{}
+			for i := len(ids) - 1; i >= 0; i-- {
+				s.mu.Lock()
+				run, ok := s.runs[ids[i]]
+				s.mu.Unlock()
+				if ok {
+					list = append(list, s.snapshot(run))
+				}
+			}
+			writeJSON(w, http.StatusOK, list)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	s.mu.Lock()
+	run, ok := s.runs[parts[1]]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown run "+parts[1])
+		return
+	}
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.snapshot(run))
+	case action == "failures" && r.Method == http.MethodGet:
+		c := s.snapshot(run)
+		if c.WorkFolder == "" {
+			writeJSON(w, http.StatusOK, []runFailure{})
+			return
+		}
+		failures, err := readFailures(c.WorkFolder)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, failures)
+	case (action == "cancel" && r.Method == http.MethodPost) || (action == "" && r.Method == http.MethodDelete):
+		if !s.Cancel(run) {
+			writeError(w, http.StatusConflict, "run "+run.ID+" is not running")
+			return
+		}
+		s.logger.Printf("run %s canceled by %s.\n", run.ID, r.RemoteAddr)
+		writeJSON(w, http.StatusAccepted, s.snapshot(run))
+	case action != "" && action != "failures" && action != "cancel":
+		writeError(w, http.StatusNotFound, "unknown route")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleStart starts a run with the source url of the optional json body.
+func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Source string `json:"source"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&body); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid json body - "+err.Error())
+		return
+	}
+	// local files of the server are not exposed to the callers.
+	if body.Source != "" {
+		u, err := url.Parse(body.Source)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeError(w, http.StatusBadRequest, "invalid source url - expected an http or https url")
+			return
+		}
+	}
+	run, err := s.Start(body.Source)
+	if err == errServerStopping {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error(), "id": run.ID})
+		return
+	}
+	w.Header().Set("Location", "/runs/"+run.ID)
+	writeJSON(w, http.StatusAccepted, s.snapshot(run))
+}
+
+// runServe is a function that parses the serve options, serves the REST API until a SIGTERM or
+// SIGINT is received and returns the exit code of the program.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", serveUsage) }
+	addr := fs.String("addr", ":8082", "")
+	authKey := fs.String("auth-key", "", "")
+	timeout := fs.Duration("shutdown-timeout", 5*time.Minute, "")
+	if err := fs.Parse(args); err != nil {
+		return exitCodeConfig
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nFailed to find the program path - Errmsg: %v\n", err)
+		return exitCodeError
+	}
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nFailed to listen on %s - Errmsg: %v\n", *addr, err)
+		return exitCodeError
+	}
+
+	logger := log.New(os.Stdout, "[ SERVE ] ", log.LstdFlags)
+	s := newServer(serveRun(executable, fs.Args()), *authKey, logger)
+	server := &http.Server{Handler: s}
+	go server.Serve(listener)
+	logger.Printf("REST API served on http://%s/runs.\n", listener.Addr())
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	sig := <-sigch
+	logger.Printf("received %v signal - stopping.\n", sig)
+	// the status stays available while the current run finishes.
+	s.Stop(*timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	logger.Println("server stopped.")
+	return exitCodeSuccess
+}
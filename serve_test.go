@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	details := `[ INFOS ] 2021/10/01 08:00:00.000001 eprocessor.go:880: success to submit record [cid: aaaa]
+[ ERROR ] 2021/10/01 08:00:00.000002 eprocessor.go:870: failure to submit record - [cid: bbbb] - Errmsg: connection refused
+{"timestamp":"2021-10-01T08:00:00Z","level":"error","run_id":"r1","cid":"cccc","http_status":400,"message":"failure to create record","error":"invalid amount"}
+`
+	stats := `[ SUCCESS ] [cid: aaaa] {"PaymentRecord":{"Name":"John"}}
+[ FAILURE ] [cid :bbbb] {"PaymentRecord":{"Name":"Jane"}}
+{"timestamp":"2021-10-01T08:00:00Z","level":"failure","run_id":"r1","cid":"cccc","http_status":400,"record":{"PaymentRecord":{"Name":"Joe"}}}
+[ FAILURE ] [sid: dddd] {"PaymentRecord":{"Name":"Jim"}}
+`
+	ioutil.WriteFile(filepath.Join(dir, "details.log"), []byte(details), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "statistics.log"), []byte(stats), 0666)
+
+	failures, err := readFailures(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []runFailure{
+		{CID: "bbbb", Error: "connection refused", Record: json.RawMessage(`{"PaymentRecord":{"Name":"Jane"}}`)},
+		{CID: "cccc", Status: 400, Error: "invalid amount", Record: json.RawMessage(`{"PaymentRecord":{"Name":"Joe"}}`)},
+		{CID: "dddd", Record: json.RawMessage(`{"PaymentRecord":{"Name":"Jim"}}`)},
+	}
+	if len(failures) != len(want) {
+		t.Fatalf("got %d failures, wanted %d: %+v", len(failures), len(want), failures)
+	}
+	for i := range want {
+		got, w := failures[i], want[i]
+		if got.CID != w.CID || got.Status != w.Status || got.Error != w.Error || string(got.Record) != string(w.Record) {
+			t.Errorf("failure %d: got %+v, wanted %+v", i, got, w)
+		}
+	}
+
+	if failures, err := readFailures(filepath.Join(dir, "missing")); err != nil || len(failures) != 0 {
+		t.Errorf("got %v (%v) for a missing folder", failures, err)
+	}
+}
+
+func TestScrapeCounts(t *testing.T) {
+	m := newMetrics()
+	m.read, m.rejected, m.succeeded, m.inflight = 800, 10, 42, 3
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	counts, err := scrapeCounts(strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int64{"read": 800, "rejected": 10, "succeeded": 42, "failed": 0, "inflight": 3} {
+		if got, ok := counts[name]; !ok || got != want {
+			t.Errorf("count %s got %d, wanted %d", name, got, want)
+		}
+	}
+}
+
+func TestServerAPI(t *testing.T) {
+	started := make(chan string, 2)
+	run := func(ctx context.Context, number int, source, metricsAddr string) runStatus {
+		started <- source
+		<-ctx.Done()
+		return runStatus{Number: number, ExitCode: exitCodeError, ExitStatus: exitError, Error: "signal: killed"}
+	}
+	s := newServer(run, "secret", log.New(ioutil.Discard, "", 0))
+
+	do := func(method, path, body string, v interface{}) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-KEY", "secret")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if v != nil {
+			json.Unmarshal(rec.Body.Bytes(), v)
+		}
+		return rec.Code
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/runs", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without api key, wanted 401", rec.Code)
+	}
+	if code := do("POST", "/runs", `{"source":"file:///etc/passwd"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("got status %d for a local source, wanted 400", code)
+	}
+
+	var r apiRun
+	if code := do("POST", "/runs", `{"source":"http://host/new.csv"}`, &r); code != http.StatusAccepted || r.ID == "" || r.State != runRunning {
+		t.Fatalf("got status %d and run %+v", code, r)
+	}
+	if source := <-started; source != "http://host/new.csv" {
+		t.Errorf("run started with source %q", source)
+	}
+	if code := do("POST", "/runs", "", nil); code != http.StatusConflict {
+		t.Errorf("got status %d while a run is going, wanted 409", code)
+	}
+	if code := do("GET", "/runs/"+r.ID+"/failures", "", nil); code != http.StatusOK {
+		t.Errorf("got status %d for the failures", code)
+	}
+	if code := do("POST", "/runs/"+r.ID+"/cancel", "", nil); code != http.StatusAccepted {
+		t.Errorf("got status %d to cancel, wanted 202", code)
+	}
+	s.Stop(time.Second)
+
+	var got apiRun
+	if code := do("GET", "/runs/"+r.ID, "", &got); code != http.StatusOK || got.State != runCanceled || got.ExitStatus != exitError {
+		t.Errorf("got status %d and run %+v after cancel", code, got)
+	}
+	if code := do("DELETE", "/runs/"+r.ID, "", nil); code != http.StatusConflict {
+		t.Errorf("got status %d to cancel a done run, wanted 409", code)
+	}
+	var list []apiRun
+	if code := do("GET", "/runs", "", &list); code != http.StatusOK || len(list) != 1 {
+		t.Errorf("got status %d and %d runs", code, len(list))
+	}
+	if code := do("POST", "/runs", "", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d while stopping, wanted 503", code)
+	}
+	if code := do("GET", "/runs/unknown", "", nil); code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown run, wanted 404", code)
+	}
+}
+
+func TestServeRunEnvParameters(t *testing.T) {
+	args, restore := helperRunArgs("http://127.0.0.1:8080/override.csv")
+	defer restore()
+
+	// the source override of a run keeps the api options of the env variables.
+	status := serveRun(os.Args[0], args)(context.Background(), 1, "http://127.0.0.1:8080/override.csv", "")
+	if status.ExitCode != exitCodeSuccess {
+		t.Errorf("got exit code %d (%s), wanted %d", status.ExitCode, status.Error, exitCodeSuccess)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// This file registers the postgres driver used by the postgres sink. It is only compiled with the
+// postgres build tag so that the default build keeps relying on native libraries only. Build with:
+//
+//	go get github.com/lib/pq && go build -tags postgres
+
+import (
+	_ "github.com/lib/pq"
+)
@@ -0,0 +1,13 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// This file registers the sqlite3 driver used by the sqlite sink. It is only compiled with the
+// sqlite build tag so that the default build keeps relying on native libraries only. Build with:
+//
+//	go get github.com/mattn/go-sqlite3 && go build -tags sqlite
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
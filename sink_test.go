@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is an in-memory stand-in of a database which records each executed statement.
+type fakeDB struct {
+	mu    sync.Mutex
+	execs []fakeExec
+	fail  bool
+}
+
+// fakeExec is a statement executed with its arguments.
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+func (db *fakeDB) Open(name string) (driver.Conn, error) { return &fakeConn{db: db}, nil }
+
+func (db *fakeDB) reset() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.execs, db.fail = nil, false
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{db: c.db}, nil }
+
+type fakeTx struct{ db *fakeDB }
+
+func (tx fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.execs = append(tx.db.execs, fakeExec{query: "COMMIT"})
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.execs = append(tx.db.execs, fakeExec{query: "ROLLBACK"})
+	return nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.db.fail {
+		return nil, errors.New("fake database failure")
+	}
+	s.db.execs = append(s.db.execs, fakeExec{query: s.query, args: args})
+	return driver.RowsAffected(1), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+var testDB = &fakeDB{}
+
+func init() {
+	sql.Register("fakesql", testDB)
+}
+
+func testJob(date string) job {
+	r := newRecord([]string{date, "Jerome AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$90", "Stripe", "08/04/2021"})
+	return job{record: r, payload: []byte(`{"PaymentRecord":{"date":"` + date + `"}}`), fingerprint: Fingerprint(r.fields(), DedupOptions{})}
+}
+
+func TestSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sqliteDriver = "fakesql"
+	defer func() { sqliteDriver = "sqlite3" }()
+	testDB.reset()
+
+	sink, stats, err := newSinks("csv:records.csv,jsonl:records.jsonl,sqlite:records.db", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Send(testJob("01/04/2016")); err != nil {
+		t.Fatal(err)
+	}
+	// the database fails for the second record only.
+	testDB.fail = true
+	if err := sink.Send(testJob("01/04/2017")); err == nil || !strings.Contains(err.Error(), "sqlite:") {
+		t.Errorf("got error %v, wanted failure of the sqlite sink", err)
+	}
+	sink.Close()
+
+	want := map[string][2]int64{"csv": {2, 0}, "jsonl": {2, 0}, "sqlite": {1, 1}}
+	for _, st := range stats {
+		kind := st.name[:strings.Index(st.name, ":")]
+		if got := [2]int64{st.success, st.failure}; got != want[kind] {
+			t.Errorf("sink %s got success/failure %v, wanted %v", st.name, got, want[kind])
+		}
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "records.csv"))
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 || lines[0] != strings.Join(fieldNames, ",") {
+		t.Errorf("got csv content %q, wanted headers and two records", data)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "records.jsonl"))
+	if string(data) != "{\"PaymentRecord\":{\"date\":\"01/04/2016\"}}\n{\"PaymentRecord\":{\"date\":\"01/04/2017\"}}\n" {
+		t.Errorf("got jsonl content %q", data)
+	}
+
+	// table creation then one insert of the fingerprint and the 12 fields.
+	if len(testDB.execs) != 2 || !strings.HasPrefix(testDB.execs[0].query, "CREATE TABLE") || len(testDB.execs[1].args) != 13 {
+		t.Errorf("got database statements %v", testDB.execs)
+	}
+
+	if _, _, err := newSinks("ftp:records", dir); err == nil {
+		t.Errorf("unknown sink should have failed")
+	}
+}
+
+func TestEmptyCSVSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a csv sink without any record still holds the headers line.
+	s, err := newFileSink("csv", filepath.Join(dir, "empty.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("got %v, wanted nil", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "empty.csv"))
+	if string(data) != strings.Join(fieldNames, ",")+"\n" {
+		t.Errorf("got csv content %q, wanted the headers line", data)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+// This file contains the summary of a run. At the end of each run, even aborted, a summary.json file is
+// written into the work folder with the run id, the start and end times, the source url and checksum,
+// the number of records at each stage, the failures by reason, the latency percentiles of the API calls
+// and the exit status so that schedulers could alert on it. A summary.html version could also be saved.
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// name of the summary files inside the work folder.
+const summaryFilename = "summary"
+
+// possible exit statuses of a run.
+const (
+	exitSuccess   = "success"
+	exitPartial   = "partial_failure"
+	exitFailure   = "total_failure"
+	exitError     = "error"
+	exitUnchanged = "source_unchanged"
+	exitOutOfSync = "out_of_sync"
+)
+
+// start time of the current run.
+var runStart time.Time
+
+// sha256 checksum of the downloaded source file.
+var sourceChecksum string
+
+// stats of the sinks used by the current run.
+var runSinkStats []*sinkStats
+
+// if true then the summary is also saved as html.
+var summaryHTML bool
+
+// RunCounts holds the number of records at each stage of a run.
+type RunCounts struct {
+	Initial    int64 `json:"initial"`
+	Rejected   int64 `json:"rejected"`
+	Duplicates int64 `json:"duplicates"`
+	Skipped    int64 `json:"skipped"`
+	Processed  int64 `json:"processed"`
+	Sent       int64 `json:"sent"`
+	Success    int64 `json:"success"`
+	Failed     int64 `json:"failed"`
+	Retried    int64 `json:"retried"`
+}
+
+// LatencySummary holds the percentiles of the API calls durations in milliseconds.
+type LatencySummary struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// SinkSummary holds the outcome of the records sent to a sink.
+type SinkSummary struct {
+	Name    string `json:"name"`
+	Success int64  `json:"success"`
+	Failed  int64  `json:"failed"`
+}
+
+// A RunSummary describes the outcome of a run.
+type RunSummary struct {
+	RunID            string           `json:"run_id"`
+	Start            time.Time        `json:"start"`
+	End              time.Time        `json:"end"`
+	DurationSeconds  float64          `json:"duration_seconds"`
+	SourceURL        string           `json:"source_url"`
+	SourceChecksum   string           `json:"source_sha256,omitempty"`
+	DryRun           bool             `json:"dry_run"`
+	Counts           RunCounts        `json:"counts"`
+	FailuresByReason map[string]int64 `json:"failures_by_reason"`
+	Methods          map[string]int64 `json:"methods,omitempty"`
+	BreakerOpened    int              `json:"breaker_opened,omitempty"`
+	Latency          LatencySummary   `json:"latency"`
+	Sinks            []SinkSummary    `json:"sinks,omitempty"`
+	Reconcile        *ReconcileCounts `json:"reconcile,omitempty"`
+	Diff             *DiffCounts      `json:"diff,omitempty"`
+	ExitStatus       string           `json:"exit_status"`
+	ExitCode         int              `json:"exit_code"`
+	Error            string           `json:"error,omitempty"`
+}
+
+// percentile returns the value at the given percentile of sorted durations in milliseconds.
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// exitStatusOf is a function that returns the exit status based on the submission outcome.
+func exitStatusOf(success, failed int64) string {
+	switch {
+	case failed == 0:
+		return exitSuccess
+	case success == 0:
+		return exitFailure
+	}
+	return exitPartial
+}
+
+// Summary builds the summary of the run from the metrics. The run is considered as aborted
+// with an error status when the error message is not empty.
+func (m *Metrics) Summary(end time.Time, errmsg string) RunSummary {
+	s := RunSummary{
+		RunID:            runID,
+		Start:            runStart,
+		End:              end,
+		DurationSeconds:  end.Sub(runStart).Seconds(),
+		SourceURL:        sourceURL,
+		SourceChecksum:   sourceChecksum,
+		DryRun:           dryRun,
+		FailuresByReason: make(map[string]int64),
+		Error:            errmsg,
+	}
+	c := &s.Counts
+	c.Initial = atomic.LoadInt64(&m.read)
+	c.Rejected = atomic.LoadInt64(&m.rejected)
+	c.Duplicates = atomic.LoadInt64(&m.deduplicated)
+	c.Skipped = atomic.LoadInt64(&m.skipped)
+	c.Processed = c.Initial - c.Rejected - c.Duplicates - c.Skipped
+	c.Success = atomic.LoadInt64(&m.succeeded)
+	c.Failed = atomic.LoadInt64(&m.failed)
+	c.Sent = c.Success + c.Failed
+	c.Retried = atomic.LoadInt64(&m.retried)
+
+	m.mu.Lock()
+	for reason, n := range m.failures {
+		s.FailuresByReason[reason] = n
+	}
+	if breaker != nil {
+		s.BreakerOpened = breaker.Opened()
+	}
+	for method, n := range m.methods {
+		if s.Methods == nil {
+			s.Methods = make(map[string]int64)
+		}
+		s.Methods[method] = n
+	}
+	// percentiles come from the sample of durations, exact up to latencyReservoirSize calls.
+	durations := append([]time.Duration(nil), m.durations...)
+	count, slowest := m.observed, m.slowest
+	m.mu.Unlock()
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	s.Latency = LatencySummary{
+		Count: int(count),
+		P50:   percentile(durations, 50),
+		P90:   percentile(durations, 90),
+		P95:   percentile(durations, 95),
+		P99:   percentile(durations, 99),
+		Max:   float64(slowest) / float64(time.Millisecond),
+	}
+
+	for _, st := range runSinkStats {
+		s.Sinks = append(s.Sinks, SinkSummary{Name: st.name, Success: atomic.LoadInt64(&st.success), Failed: atomic.LoadInt64(&st.failure)})
+	}
+
+	s.ExitStatus = exitStatusOf(c.Success, c.Failed)
+	// a reconciliation succeeds only when the backend holds the same records.
+	if reconcileCounts != nil {
+		counts := *reconcileCounts
+		s.Reconcile = &counts
+		if s.ExitStatus == exitSuccess && !counts.InSync() {
+			s.ExitStatus = exitOutOfSync
+		}
+	}
+	if diffCounts != nil {
+		counts := *diffCounts
+		s.Diff = &counts
+	}
+	if errmsg != "" {
+		s.ExitStatus = exitError
+	}
+	s.ExitCode = exitCodeOf(s.ExitStatus)
+	return s
+}
+
+// summaryTemplate is the html page of the summary for humans.
+var summaryTemplate = template.Must(template.New("summary").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>eprocessor - run {{.RunID}}</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse;margin-bottom:16px}td,th{border:1px solid #ccc;padding:4px 8px;text-align:left}</style>
+</head>
+<body>
+<h1>Run {{.RunID}} - {{.ExitStatus}}</h1>
+{{if .Error}}<p><b>Error:</b> {{.Error}}</p>{{end}}
+<table>
+<tr><th>Start</th><td>{{.Start.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>End</th><td>{{.End.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Duration</th><td>{{printf "%.1f" .DurationSeconds}} seconds</td></tr>
+<tr><th>Source</th><td>{{.SourceURL}}</td></tr>
+<tr><th>Checksum (sha256)</th><td>{{.SourceChecksum}}</td></tr>
+<tr><th>Dry-run</th><td>{{.DryRun}}</td></tr>
+{{if .BreakerOpened}}<tr><th>Circuit breaker opened</th><td>{{.BreakerOpened}} times</td></tr>{{end}}
+</table>
+<h2>Records</h2>
+<table>
+<tr><th>Initial</th><th>Rejected</th><th>Duplicates</th><th>Skipped</th><th>Processed</th><th>Sent</th><th>Success</th><th>Failed</th><th>Retried</th></tr>
+{{with .Counts}}<tr><td>{{.Initial}}</td><td>{{.Rejected}}</td><td>{{.Duplicates}}</td><td>{{.Skipped}}</td><td>{{.Processed}}</td><td>{{.Sent}}</td><td>{{.Success}}</td><td>{{.Failed}}</td><td>{{.Retried}}</td></tr>{{end}}
+</table>
+{{if .FailuresByReason}}<h2>Failures by reason</h2>
+<table>
+<tr><th>Reason</th><th>Records</th></tr>
+{{range $reason, $n := .FailuresByReason}}<tr><td>{{$reason}}</td><td>{{$n}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Methods}}<h2>Records by method</h2>
+<table>
+<tr><th>Method</th><th>Records</th></tr>
+{{range $method, $n := .Methods}}<tr><td>{{$method}}</td><td>{{$n}}</td></tr>
+{{end}}</table>{{end}}
+<h2>Latency of {{.Latency.Count}} API calls (ms)</h2>
+<table>
+<tr><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>max</th></tr>
+{{with .Latency}}<tr><td>{{printf "%.1f" .P50}}</td><td>{{printf "%.1f" .P90}}</td><td>{{printf "%.1f" .P95}}</td><td>{{printf "%.1f" .P99}}</td><td>{{printf "%.1f" .Max}}</td></tr>{{end}}
+</table>
+{{with .Reconcile}}<h2>Reconciliation</h2>
+<table>
+<tr><th>Local</th><th>Remote</th><th>Matched</th><th>Missing</th><th>Extra</th><th>Mismatched</th><th>Unreadable</th><th>Resubmitted</th></tr>
+<tr><td>{{.Local}}</td><td>{{.Remote}}</td><td>{{.Matched}}</td><td>{{.Missing}}</td><td>{{.Extra}}</td><td>{{.Mismatched}}</td><td>{{.Unreadable}}</td><td>{{.Resubmitted}}</td></tr>
+</table>{{end}}
+{{with .Diff}}<h2>Differences</h2>
+<table>
+<tr><th>Old</th><th>New</th><th>Added</th><th>Removed</th><th>Modified</th><th>Unchanged</th><th>Invalid</th><th>Deleted</th><th>Delete failed</th></tr>
+<tr><td>{{.Old}}</td><td>{{.New}}</td><td>{{.Added}}</td><td>{{.Removed}}</td><td>{{.Modified}}</td><td>{{.Unchanged}}</td><td>{{.Invalid}}</td><td>{{.Deleted}}</td><td>{{.DeleteFailed}}</td></tr>
+</table>{{end}}
+{{if .Sinks}}<h2>Sinks</h2>
+<table>
+<tr><th>Sink</th><th>Success</th><th>Failed</th></tr>
+{{range .Sinks}}<tr><td>{{.Name}}</td><td>{{.Success}}</td><td>{{.Failed}}</td></tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))
+
+// saveSummary is a function that writes the summary into the summary.json file of the work
+// folder and into the summary.html file when the html flag is set.
+func saveSummary(folder string, s RunSummary, html bool) error {
+	base := folder + string(os.PathSeparator) + summaryFilename
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(base+".json", append(data, '\n'), 0666); err != nil {
+		return err
+	}
+	if !html {
+		return nil
+	}
+	f, err := os.Create(base + ".html")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return summaryTemplate.Execute(f, s)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var durations []time.Duration
+	for i := 1; i <= 100; i++ {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+	for p, want := range map[float64]float64{50: 50, 95: 95, 99: 99, 100: 100, 0: 1} {
+		if got := percentile(durations, p); got != want {
+			t.Errorf("p%v got %v, wanted %v", p, got, want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("got %v for no durations", got)
+	}
+}
+
+func TestExitStatusOf(t *testing.T) {
+	tests := []struct {
+		success, failed int64
+		want            string
+	}{{10, 0, exitSuccess}, {0, 0, exitSuccess}, {8, 2, exitPartial}, {0, 3, exitFailure}}
+	for _, tt := range tests {
+		if got := exitStatusOf(tt.success, tt.failed); got != tt.want {
+			t.Errorf("exitStatusOf(%d, %d) got %s, wanted %s", tt.success, tt.failed, got, tt.want)
+		}
+	}
+}
+
+func TestSaveSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newMetrics()
+	m.read, m.rejected, m.deduplicated = 800, 10, 517
+	now := time.Now()
+	for i := 0; i < 273; i++ {
+		var err error
+		if i < 3 {
+			err = errors.New("api status 500")
+		}
+		m.ObserveLatency("201", time.Duration(i+1)*time.Millisecond)
+		m.Done(err, now)
+	}
+	runStart = now.Add(-time.Minute)
+	s := m.Summary(now, "")
+	if s.Counts.Processed != 273 || s.Counts.Sent != 273 || s.Counts.Failed != 3 || s.FailuresByReason["api status 500"] != 3 ||
+		s.ExitStatus != exitPartial || s.Latency.Count != 273 || s.Latency.Max != 273 || s.DurationSeconds != 60 {
+		t.Errorf("got summary %+v", s)
+	}
+	if aborted := m.Summary(now, "failed to download"); aborted.ExitStatus != exitError {
+		t.Errorf("got exit status %s for aborted run", aborted.ExitStatus)
+	}
+
+	if err := saveSummary(dir, s, true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded RunSummary
+	if err := json.Unmarshal(data, &loaded); err != nil || loaded.Counts != s.Counts {
+		t.Errorf("got saved summary %s (err: %v)", data, err)
+	}
+	html, _ := ioutil.ReadFile(filepath.Join(dir, "summary.html"))
+	if !strings.Contains(string(html), "partial_failure") || !strings.Contains(string(html), "<td>api status 500</td><td>3</td>") {
+		t.Errorf("got summary page %s", html)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+// This file contains the upsert mode. The API flow only creates records with POST calls so a corrected
+// payment becomes a duplicate on the backend. With the -upsert option, each record updates its own
+// resource with a PUT or PATCH call on the -resource-url template built from its fields (for example
+// /records/{date}-{name}-{amount} resolved against the api url). An unknown resource (404) is created
+// with a POST call instead. The method which handled each record is kept into the statistics.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// http method (PUT or PATCH) updating the resource of each record - records are only posted when empty.
+var upsertMethod string
+
+// url template of the resource of a record - relative to the api url or absolute.
+var resourceURL string
+
+// errResourceNotFound is returned when the resource to update does not exist on the backend.
+var errResourceNotFound = errors.New("resource not found")
+
+// parseUpsertMethod is a function that converts the upsert option into its http method.
+func parseUpsertMethod(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		return "", nil
+	case "put":
+		return http.MethodPut, nil
+	case "patch":
+		return http.MethodPatch, nil
+	}
+	return "", fmt.Errorf("unknown upsert mode %q - expected put or patch", mode)
+}
+
+// recordResourceURL is a function that builds the url of the resource of a record by expanding the
+// template then resolving it against the api url.
+func recordResourceURL(tmpl, base string, r Record) (string, error) {
+	ref, err := url.Parse(expandRecordTemplate(tmpl, r))
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	return u.ResolveReference(ref).String(), nil
+}
+
+// paymentTarget is a function that returns the method and the url of the first request sending a record.
+func paymentTarget(r Record) (string, string) {
+	if upsertMethod == "" {
+		return http.MethodPost, apiURL
+	}
+	target, err := recordResourceURL(resourceURL, apiURL, r)
+	if err != nil {
+		// the template is checked at startup so only unexpected record values could fail here.
+		return http.MethodPost, apiURL
+	}
+	return upsertMethod, target
+}
+
+// methodTag is a function that returns the prefix of the statistics entries naming the http method.
+// Entries stay unchanged when records are only posted.
+func methodTag(method string) string {
+	if upsertMethod == "" {
+		return ""
+	}
+	return "[method: " + method + "] "
+}
+
+// sendPaymentRecord is a function that sends the payload of a job to the API. In upsert mode the resource
+// of the record is updated and created with a POST call when it does not exist yet.
+func sendPaymentRecord(j job) error {
+	method, target := paymentTarget(j.record)
+	err := postPaymentRecord(method, target, j.payload, j.fingerprint)
+	if err == errResourceNotFound {
+		logInfos.With(logFields{Fingerprint: j.fingerprint}).Printf("resource %s not found - falling back to %s %s", target, http.MethodPost, apiURL)
+		method = http.MethodPost
+		err = postPaymentRecord(method, apiURL, j.payload, j.fingerprint)
+	}
+	metrics.CountMethod(method)
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRecordResourceURL(t *testing.T) {
+	r := newRecord([]string{"01/02/2024", "Jane Doe", "", "", "Krakow", "", "", "", "", "$10", "", ""})
+	tests := []struct {
+		tmpl, base, want string
+	}{
+		{"/records/{date}-{name}-{amount}", "http://host:8080/records", "http://host:8080/records/01%2F02%2F2024-Jane%20Doe-$10"},
+		{"{name}", "http://host/api/records/", "http://host/api/records/Jane%20Doe"},
+		{"https://other/items/{city}", "http://host/records", "https://other/items/Krakow"},
+	}
+	for _, tt := range tests {
+		got, err := recordResourceURL(tt.tmpl, tt.base, r)
+		if err != nil || got != tt.want {
+			t.Errorf("got %q, %v for %q on %q, wanted %q", got, err, tt.tmpl, tt.base, tt.want)
+		}
+	}
+
+	for mode, want := range map[string]string{"": "", "put": http.MethodPut, "PATCH": http.MethodPatch} {
+		if got, err := parseUpsertMethod(mode); err != nil || got != want {
+			t.Errorf("got %q, %v for mode %q, wanted %q", got, err, mode, want)
+		}
+	}
+	if _, err := parseUpsertMethod("post"); err == nil {
+		t.Error("parseUpsertMethod accepted post")
+	}
+}
+
+func TestSendPaymentRecordUpsert(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	existing := map[string]bool{"/records/Alice": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.EscapedPath())
+		mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+		case existing[r.URL.EscapedPath()]:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	defer func(api, method, tmpl string, m *Metrics) {
+		apiURL, upsertMethod, resourceURL, metrics = api, method, tmpl, m
+	}(apiURL, upsertMethod, resourceURL, metrics)
+	apiURL, upsertMethod, resourceURL, metrics = server.URL+"/records", http.MethodPut, "/records/{name}", newMetrics()
+
+	_, stats, restore := captureLoggers()
+	defer restore()
+
+	for _, name := range []string{"Alice", "Bob"} {
+		j := job{record: newRecord([]string{"01/02/2024", name, "", "", "", "", "", "", "", "$10", "", ""}), payload: []byte(`{}`)}
+		if err := sendPaymentRecord(j); err != nil {
+			t.Fatalf("sendPaymentRecord(%s) failed: %v", name, err)
+		}
+	}
+
+	want := []string{"PUT /records/Alice", "PUT /records/Bob", "POST /records"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Errorf("got calls %v, wanted %v", calls, want)
+	}
+	if metrics.methods[http.MethodPut] != 1 || metrics.methods[http.MethodPost] != 1 {
+		t.Errorf("got methods %v, wanted one PUT and one POST", metrics.methods)
+	}
+	if !strings.Contains(stats.String(), "[method: PUT] {}") || !strings.Contains(stats.String(), "[method: POST] {}") {
+		t.Errorf("statistics do not hold the methods:\n%s", stats.String())
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+// This file contains the optional typed model of a payment record. When enabled, each record
+// goes through the validation stage which parses the date and amount fields into real values
+// and checks the zipcode and phone fields against basic format rules. Invalid records are not
+// submitted and are routed into the rejects.csv file of the work folder with the reason.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// default layout of the dates into the source file (month/day/year).
+const defaultDateLayouts = "01/02/2006"
+
+// default currency code applied to amounts which do not mention any.
+const defaultCurrency = "USD"
+
+// name of the file inside the work folder where invalid records are saved.
+const rejectsFilename = "rejects.csv"
+
+// records rejected by the validation or the normalization of the last prepared file.
+var preparedRejects [][]string
+
+// a zipcode is made of letters or digits with optional inner space or hyphen.
+var zipcodePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 -]{1,8}[A-Za-z0-9]$`)
+
+// a phone number is made of digits with optional leading plus sign and common separators.
+var phonePattern = regexp.MustCompile(`^\+?[0-9 ().-]+$`)
+
+// A TypedRecord is the typed version of a Record once its fields have been validated.
+type TypedRecord struct {
+	Date       time.Time
+	Name       string
+	Address    string
+	Address2   string
+	City       string
+	State      string
+	Zipcode    string
+	Telephone  string
+	Mobile     string
+	Amount     Money
+	Processor  string
+	ImportDate time.Time
+	// original amount value when the normalization stage has been applied.
+	AmountOriginal string
+}
+
+// A TypedPaymentRecord is a structure to be used to build typed json string before posting to API.
+type TypedPaymentRecord struct {
+	PaymentRecord TypedRecord `json:"PaymentRecord"`
+}
+
+// MarshalJSON formats dates as YYYY-MM-DD and splits the amount into decimal value and currency.
+func (t TypedRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Date       string `json:"date"`
+		Name       string `json:"name"`
+		Address    string `json:"address"`
+		Address2   string `json:"address2"`
+		City       string `json:"city"`
+		State      string `json:"state"`
+		Zipcode    string `json:"zipcode"`
+		Telephone  string `json:"telephone"`
+		Mobile     string `json:"mobile"`
+		Amount     string `json:"amount"`
+		Currency   string `json:"currency"`
+		Processor  string `json:"processor"`
+		ImportDate string `json:"importdate"`
+		Original   string `json:"amount_original,omitempty"`
+	}{
+		Date:       t.Date.Format("2006-01-02"),
+		Name:       t.Name,
+		Address:    t.Address,
+		Address2:   t.Address2,
+		City:       t.City,
+		State:      t.State,
+		Zipcode:    t.Zipcode,
+		Telephone:  t.Telephone,
+		Mobile:     t.Mobile,
+		Amount:     t.Amount.String(),
+		Currency:   t.Amount.Currency,
+		Processor:  t.Processor,
+		ImportDate: t.ImportDate.Format("2006-01-02"),
+		Original:   t.AmountOriginal,
+	})
+}
+
+// A rejectedRecord is a record which failed one processing stage along with the reason.
+type rejectedRecord struct {
+	record []string
+	reason string
+}
+
+// isMissing reports if the value has been flagged as empty by ReplaceEmptyValues.
+func isMissing(value string) bool {
+	return value == "missing" || len(strings.TrimSpace(value)) == 0
+}
+
+// ParseDate is a function that parses the value by trying each layout in order.
+func ParseDate(value string, layouts []string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q - expected layouts %s", value, strings.Join(layouts, " or "))
+}
+
+// ValidateZipcode is a function that checks the zipcode format. Missing value is accepted.
+func ValidateZipcode(value string) error {
+	if isMissing(value) || zipcodePattern.MatchString(value) {
+		return nil
+	}
+	return fmt.Errorf("invalid zipcode %q", value)
+}
+
+// ValidatePhone is a function that checks the phone format and that it holds between 7 and 15 digits.
+// Missing value is accepted since telephone and mobile are optional.
+func ValidatePhone(value string) error {
+	if isMissing(value) {
+		return nil
+	}
+	digits := 0
+	for _, c := range value {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	if !phonePattern.MatchString(value) || digits < 7 || digits > 15 {
+		return fmt.Errorf("invalid phone number %q", value)
+	}
+	return nil
+}
+
+// NewTypedRecord is a function that parses and validates a processed record into a TypedRecord.
+// It returns an error mentioning all invalid fields when the record does not pass the validation.
+func NewTypedRecord(record []string, layouts []string, currency string) (TypedRecord, error) {
+	var reasons []string
+	r := newRecord(record)
+	t := TypedRecord{
+		Name:      r.Name,
+		Address:   r.Address,
+		Address2:  r.Address2,
+		City:      r.City,
+		State:     r.State,
+		Zipcode:   r.Zipcode,
+		Telephone: r.Telephone,
+		Mobile:    r.Mobile,
+		Processor: r.Processor,
+	}
+
+	var err error
+	if t.Date, err = ParseDate(r.Date, layouts); err != nil {
+		reasons = append(reasons, err.Error())
+	}
+	// the import date is always generated by the program in the default layout.
+	if t.ImportDate, err = time.Parse(defaultDateLayouts, r.ImportDate); err != nil {
+		reasons = append(reasons, fmt.Sprintf("invalid import date %q", r.ImportDate))
+	}
+	if t.Amount, err = ParseAmount(r.Amount, currency); err != nil {
+		reasons = append(reasons, err.Error())
+	}
+	if err = ValidateZipcode(r.Zipcode); err != nil {
+		reasons = append(reasons, err.Error())
+	}
+	if err = ValidatePhone(r.Telephone); err != nil {
+		reasons = append(reasons, "telephone: "+err.Error())
+	}
+	if err = ValidatePhone(r.Mobile); err != nil {
+		reasons = append(reasons, "mobile: "+err.Error())
+	}
+
+	if len(reasons) > 0 {
+		return t, errors.New(strings.Join(reasons, "; "))
+	}
+	return t, nil
+}
+
+// ValidateRecords is a function that keeps only the records which pass the typed validation.
+// Each invalid record is returned as rejected with the reason of its rejection.
+func ValidateRecords(records [][]string, layouts []string, currency string) ([][]string, []rejectedRecord) {
+	var rejects []rejectedRecord
+	valid := records[:0]
+	for _, record := range records {
+		if _, err := NewTypedRecord(record, layouts, currency); err != nil {
+			rejects = append(rejects, rejectedRecord{record: record, reason: err.Error()})
+			continue
+		}
+		valid = append(valid, record)
+	}
+	return valid, rejects
+}
+
+// saveRejects is a function that appends the rejected records with their reason into the
+// rejects.csv file of the work folder. The headers line is written when creating the file.
+func saveRejects(folder string, rejects []rejectedRecord) error {
+	if len(rejects) == 0 {
+		return nil
+	}
+	path := folder + string(os.PathSeparator) + rejectsFilename
+	_, err := os.Stat(path)
+	exists := err == nil
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if !exists {
+		w.Write([]string{"Date", "Name", "Address", "Address2", "City", "State", "Zipcode", "Telephone", "Mobile", "Amount", "Processor", "ImportDate", "Reason"})
+	}
+	for _, reject := range rejects {
+		w.Write(append(append([]string{}, reject.record...), reject.reason))
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// splitList is a function that splits a comma separated flag value into trimmed non-empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
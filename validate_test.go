@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewTypedRecord(t *testing.T) {
+	layouts := []string{"01/02/2006", "2006-01-02"}
+
+	valid := []string{"2016-04-01", "Jerome AMON", "Poland Street", "missing", "Warsaw", "PL", "38002", "missing", "000-000-0000", "$90", "Stripe", "08/04/2021"}
+	r, err := NewTypedRecord(valid, layouts, "USD")
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if r.Date.Format("2006-01-02") != "2016-04-01" || r.Amount.String() != "90.00" {
+		t.Errorf("got date %v and amount %v, wanted 2016-04-01 and 90.00", r.Date, r.Amount)
+	}
+
+	invalid := []string{"13/45/2016", "Jerome AMON", "Poland Street", "missing", "Warsaw", "PL", "3@002", "missing", "12", "abc", "Stripe", "08/04/2021"}
+	valids, rejects := ValidateRecords([][]string{valid, invalid}, layouts, "USD")
+	if len(valids) != 1 || len(rejects) != 1 {
+		t.Fatalf("got %d valid and %d rejected records, wanted 1 and 1", len(valids), len(rejects))
+	}
+	// date, zipcode, mobile and amount are all invalid.
+	for _, field := range []string{"date", "zipcode", "mobile", "amount"} {
+		if !strings.Contains(rejects[0].reason, field) {
+			t.Errorf("reason %q does not mention the %s field", rejects[0].reason, field)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+// This file contains the watch subcommand. It polls a drop directory (e.g. fed by SFTP) and processes each
+// new file through the pipeline once the file is fully written, which means its size and modification time
+// did not change during the settle duration. Like the daemon, each file is processed by a child process of
+// the program into batch mode with its own work folder. Then the file is moved into the processed/ or the
+// failed/ subdirectory with its statistics.log and summary.json files next to it.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const watchUsage = `Usage:
+
+    eprocessor watch <directory> [watch options] [-- pipeline options]
+
+Watch options:
+    -interval  Time between two scans of the directory (default 2s).
+    -settle    Time during which the size of a new file must not change before processing it (default 5s).
+    -pattern   Pattern of the names of the files to process (default *.csv).
+
+Pipeline options are the options of a normal run (e.g. -api, -key, -sinks) except -source which is set to
+each new file. The -api and -key options not provided are loaded from the EPROCESSOR_* environment variables.
+Processed files are moved into the processed/ subdirectory and files with failures (aborted run, partial
+or total failure) into the failed/ subdirectory, each one with its .statistics.log and .summary.json files.
+A file which could not be moved is not processed again until it changes. On SIGTERM or SIGINT the run of
+the current file is canceled and the file is left in place.
+`
+
+// subdirectories of the watched directory receiving the files once processed.
+const (
+	watchProcessed = "processed"
+	watchFailed    = "failed"
+)
+
+// sourceTransport is a function that returns the transport used to download the source file.
+// Besides http and https urls, it fetches local files with file:///path/to/data.csv urls.
+func sourceTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return t
+}
+
+// fileState is the last observed state of a file of the watched directory.
+type fileState struct {
+	size    int64
+	modTime time.Time
+	// time when the file was first seen with this size and modification time.
+	since time.Time
+}
+
+// A Watcher finds the files of a directory which are ready to be processed.
+type Watcher struct {
+	dir     string
+	pattern string
+	settle  time.Duration
+	files   map[string]fileState
+	// files already processed but left in the directory, with the state they had at that time.
+	processed map[string]fileState
+}
+
+// newWatcher is a function that creates a watcher of the directory.
+func newWatcher(dir, pattern string, settle time.Duration) *Watcher {
+	return &Watcher{dir: dir, pattern: pattern, settle: settle, files: make(map[string]fileState), processed: make(map[string]fileState)}
+}
+
+// Processed marks a ready file as processed so that it is not returned again while it stays in the
+// directory unchanged, like when it could not be moved away. A new file with the same name is processed.
+func (w *Watcher) Processed(path string) {
+	name := filepath.Base(path)
+	if state, ok := w.files[name]; ok {
+		w.processed[name] = state
+	}
+}
+
+// Poll scans the directory and returns the paths of the matching files whose size and modification
+// time did not change for the settle duration, by name order. Hidden files are ignored.
+func (w *Watcher) Poll(now time.Time) ([]string, error) {
+	f, err := os.Open(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var ready []string
+	present := make(map[string]bool)
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if ok, _ := filepath.Match(w.pattern, name); !ok {
+			continue
+		}
+		present[name] = true
+		if done, ok := w.processed[name]; ok && done.size == info.Size() && done.modTime.Equal(info.ModTime()) {
+			continue
+		}
+		delete(w.processed, name)
+		state, seen := w.files[name]
+		if !seen || state.size != info.Size() || !state.modTime.Equal(info.ModTime()) {
+			// new file or still being written.
+			w.files[name] = fileState{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+		if now.Sub(state.since) >= w.settle {
+			ready = append(ready, filepath.Join(w.dir, name))
+		}
+	}
+	// forget the files which were moved or deleted.
+	for name := range w.files {
+		if !present[name] {
+			delete(w.files, name)
+		}
+	}
+	for name := range w.processed {
+		if !present[name] {
+			delete(w.processed, name)
+		}
+	}
+	sort.Strings(ready)
+	return ready, nil
+}
+
+// copyFile is a function that copies the content of a file into a new file.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// moveProcessed is a function that moves the processed file into the processed or the failed
+// subdirectory depending on the run status and copies the statistics and summary files of the
+// run next to it. A file with the same name already moved is not overwritten. It returns the
+// new path of the file.
+func moveProcessed(path string, status runStatus) (string, error) {
+	sub := watchProcessed
+	if status.ExitCode != exitCodeSuccess && status.ExitCode != exitCodeUnchanged {
+		sub = watchFailed
+	}
+	dir := filepath.Join(filepath.Dir(path), sub)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, filepath.Base(path))
+	if _, err := os.Stat(dest); err == nil {
+		dest = filepath.Join(dir, status.Start.Format("20060102.150405")+"-"+filepath.Base(path))
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return "", err
+	}
+	if status.WorkFolder == "" {
+		return dest, nil
+	}
+	for _, name := range []string{"statistics.log", summaryFilename + ".json"} {
+		src := filepath.Join(status.WorkFolder, name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := copyFile(src, dest+"."+name); err != nil {
+			return dest, err
+		}
+	}
+	return dest, nil
+}
+
+// watchRunArgs is a function that returns the arguments of the run processing the file at path: the
+// pipeline options followed by the file as source.
+func watchRunArgs(pipeline []string, path string) []string {
+	return append(append([]string(nil), pipeline...), "-source", "file://"+filepath.ToSlash(path))
+}
+
+// runWatch is a function that parses the watch options, processes the new files of the directory
+// until a SIGTERM or SIGINT is received and returns the exit code of the program.
+func runWatch(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintf(os.Stderr, "%s\n", watchUsage)
+		return exitCodeConfig
+	}
+	dir := args[0]
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", watchUsage) }
+	interval := fs.Duration("interval", 2*time.Second, "")
+	settle := fs.Duration("settle", 5*time.Second, "")
+	pattern := fs.String("pattern", "*.csv", "")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitCodeConfig
+	}
+	if _, err := filepath.Match(*pattern, ""); err != nil || *interval <= 0 || *settle < 0 {
+		fmt.Fprintf(os.Stderr, "\nInvalid watch options - pattern: %q / interval: %s / settle: %s.\n", *pattern, *interval, *settle)
+		fs.Usage()
+		return exitCodeConfig
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "\nThe watched directory %q does not exist.\n", dir)
+		return exitCodeConfig
+	}
+	// the child processes need an absolute path of each file.
+	dir, _ = filepath.Abs(dir)
+
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nFailed to find the program path - Errmsg: %v\n", err)
+		return exitCodeError
+	}
+
+	logger := log.New(os.Stdout, "[ WATCH ] ", log.LstdFlags)
+	// the run of the current file is canceled on stop.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	go func() {
+		sig := <-sigch
+		logger.Printf("received %v signal - stopping and canceling the current file.\n", sig)
+		stop()
+	}()
+
+	logger.Printf("watching %s for %s files.\n", dir, *pattern)
+	w := newWatcher(dir, *pattern, *settle)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	number := 0
+	for {
+		files, err := w.Poll(time.Now())
+		if err != nil {
+			logger.Printf("failed to scan the directory - Errmsg: %v\n", err)
+		}
+		for _, path := range files {
+			if ctx.Err() != nil {
+				logger.Println("watch stopped.")
+				return exitCodeSuccess
+			}
+			number++
+			logger.Printf("processing %s.\n", path)
+			run := childRun(executable, watchRunArgs(fs.Args(), path))
+			status := run(ctx, number)
+			if ctx.Err() != nil {
+				// the file is processed again at the next start.
+				logger.Printf("%s canceled - left in place.\n", filepath.Base(path))
+				continue
+			}
+			dest, err := moveProcessed(path, status)
+			if err != nil {
+				w.Processed(path)
+				logger.Printf("failed to move %s - left in place and skipped until it changes - Errmsg: %v\n", path, err)
+				continue
+			}
+			logger.Printf("%s ended with %s status (exit code %d) - moved to %s.\n", filepath.Base(path), status.ExitStatus, status.ExitCode, dest)
+		}
+		select {
+		case <-ctx.Done():
+			logger.Println("watch stopped.")
+			return exitCodeSuccess
+		case <-ticker.C:
+		}
+	}
+}
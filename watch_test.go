@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatcherPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("b.csv", "Date,Name\n")
+	write("a.csv", "Date,Name\n")
+	write(".hidden.csv", "Date,Name\n")
+	write("notes.txt", "ignored")
+	os.Mkdir(filepath.Join(dir, watchProcessed), 0755)
+
+	w := newWatcher(dir, "*.csv", time.Second)
+	start := time.Now()
+	if files, _ := w.Poll(start); len(files) != 0 {
+		t.Fatalf("got %v ready at first sight", files)
+	}
+	// a.csv is still being written.
+	write("a.csv", "Date,Name\n01/01/2021,John\n")
+	files, err := w.Poll(start.Add(2 * time.Second))
+	if err != nil || !reflect.DeepEqual(files, []string{filepath.Join(dir, "b.csv")}) {
+		t.Fatalf("got %v (%v), wanted only b.csv", files, err)
+	}
+	files, _ = w.Poll(start.Add(4 * time.Second))
+	if !reflect.DeepEqual(files, []string{filepath.Join(dir, "a.csv"), filepath.Join(dir, "b.csv")}) {
+		t.Fatalf("got %v, wanted a.csv and b.csv", files)
+	}
+	os.Remove(filepath.Join(dir, "b.csv"))
+	w.Poll(start.Add(5 * time.Second))
+	if _, ok := w.files["b.csv"]; ok || len(w.files) != 1 {
+		t.Errorf("removed file still tracked: %v", w.files)
+	}
+
+	// a processed file left in place is skipped until it changes.
+	w.Processed(filepath.Join(dir, "a.csv"))
+	if files, _ := w.Poll(start.Add(10 * time.Second)); len(files) != 0 {
+		t.Fatalf("got %v, wanted the processed a.csv to be skipped", files)
+	}
+	write("a.csv", "Date,Name\n01/02/2021,Jane\n01/03/2021,Jim\n")
+	w.Poll(start.Add(11 * time.Second))
+	files, _ = w.Poll(start.Add(13 * time.Second))
+	if !reflect.DeepEqual(files, []string{filepath.Join(dir, "a.csv")}) {
+		t.Errorf("got %v, wanted the new a.csv", files)
+	}
+}
+
+func TestMoveProcessed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	work := filepath.Join(dir, "log@20211001.080000")
+	os.Mkdir(work, 0755)
+	ioutil.WriteFile(filepath.Join(work, "statistics.log"), []byte("stats"), 0666)
+	ioutil.WriteFile(filepath.Join(work, "summary.json"), []byte("{}"), 0666)
+
+	tests := []struct {
+		status runStatus
+		want   string
+	}{
+		{runStatus{ExitCode: exitCodeSuccess, WorkFolder: work}, filepath.Join(dir, "processed", "data.csv")},
+		{runStatus{ExitCode: exitCodePartial, WorkFolder: work}, filepath.Join(dir, "failed", "data.csv")},
+		{runStatus{ExitCode: exitCodeUnchanged, Start: time.Date(2021, 10, 2, 8, 0, 0, 0, time.UTC)}, filepath.Join(dir, "processed", "20211002.080000-data.csv")},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "data.csv")
+		ioutil.WriteFile(path, []byte("Date,Name\n"), 0666)
+		dest, err := moveProcessed(path, tt.status)
+		if err != nil || dest != tt.want {
+			t.Errorf("got %q (%v), wanted %q", dest, err, tt.want)
+			continue
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not moved", path)
+		}
+		_, errStats := os.Stat(dest + ".statistics.log")
+		_, errSummary := os.Stat(dest + ".summary.json")
+		if withStats := tt.status.WorkFolder != ""; (errStats == nil) != withStats || (errSummary == nil) != withStats {
+			t.Errorf("%s: unexpected run files - %v / %v", dest, errStats, errSummary)
+		}
+	}
+}
+
+func TestSourceTransport(t *testing.T) {
+	f, err := ioutil.TempFile("", "source*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("Date,Name\n")
+	f.Close()
+
+	client := http.Client{Transport: sourceTransport()}
+	path, _ := filepath.Abs(f.Name())
+	resp, err := client.Get("file://" + filepath.ToSlash(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(data) != "Date,Name\n" {
+		t.Errorf("got status %d and content %q", resp.StatusCode, data)
+	}
+	resp, err = client.Get("file://" + filepath.ToSlash(path) + ".missing")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %v for a missing file", err)
+	}
+}
+
+func TestWatchRunEnvParameters(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "drop", "data.csv")
+	args, restore := helperRunArgs("file://" + filepath.ToSlash(path))
+	defer restore()
+
+	// the file is the source of a run whose api options come from the env variables.
+	status := childRun(os.Args[0], watchRunArgs(args, path))(context.Background(), 1)
+	if status.ExitCode != exitCodeSuccess {
+		t.Errorf("got exit code %d (%s), wanted %d", status.ExitCode, status.Error, exitCodeSuccess)
+	}
+}